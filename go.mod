@@ -0,0 +1,56 @@
+module solidity/native_example
+
+go 1.20
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/aristanetworks/goarista v0.0.0-20170210015632-ea17b1a17847
+	github.com/btcsuite/btcd v0.0.0-20171128150713-2e60448ffcc6
+	github.com/davecgh/go-spew v1.1.1
+	github.com/deckarep/golang-set v0.0.0-20180603214616-504e848d77ea
+	github.com/edsrzf/mmap-go v0.0.0-20160512033002-935e0e8a636c
+	github.com/ethereum/go-ethereum v1.8.10
+	github.com/go-stack/stack v1.8.0
+	github.com/golang/protobuf v1.4.3
+	github.com/golang/snappy v0.0.1
+	github.com/gorilla/websocket v1.4.1-0.20190629185528-ae1634f6a989
+	github.com/hashicorp/golang-lru v0.0.0-20160813221303-0a025b7e63ad
+	github.com/huin/goupnp v0.0.0-20161224104101-679507af18f3
+	github.com/jackpal/go-nat-pmp v1.0.2-0.20160603034137-1fa385a6f458
+	github.com/karalabe/hid v0.0.0-20170821103837-f00545f9f374
+	github.com/mattn/go-isatty v0.0.5-0.20180830101745-3fb116b82035
+	github.com/pborman/uuid v0.0.0-20170112150404-1b00554d8222
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/rjeczalik/notify v0.9.1
+	github.com/rs/cors v0.0.0-20160617231935-a62a804a8a00
+	github.com/rs/xhandler v0.0.0-20160618193221-ed27b6fd6521
+	github.com/syndtr/goleveldb v1.0.1-0.20190923125748-758128399b1d
+	github.com/wsddn/go-ecdh v0.0.0-20161211032359-48726bab9208
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+	golang.org/x/sys v0.4.0
+	golang.org/x/text v0.3.7
+	gopkg.in/fatih/set.v0 v0.1.0
+	gopkg.in/karalabe/cookiejar.v2 v2.0.0-20150724131613-8dcd6a7f4951
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/fatih/color v1.3.0 // indirect
+	github.com/mattn/go-colorable v0.1.0 // indirect
+	github.com/mattn/go-runewidth v0.0.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/peterh/liner v1.1.1-0.20190123174540-a2c9a5303de7 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	github.com/rcrowley/go-metrics v0.0.0-20250401214520-65e299d6c5c9 // indirect
+	github.com/robertkrimen/otto v0.0.0-20170205013659-6a77b7cbc37d // indirect
+	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4 // indirect
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b // indirect
+	golang.org/x/tools v0.1.12 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
+	gopkg.in/sourcemap.v1 v1.0.5 // indirect
+)
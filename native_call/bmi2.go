@@ -0,0 +1,10 @@
+package main
+
+import _ "unsafe"
+
+// supportBMI2 stands in for the runtime flag that Go 1.17 dropped; the
+// bn256 assembly of go-ethereum 1.8 still reads it to pick MULX, so leaving
+// it false keeps the portable code path.
+//
+//go:linkname supportBMI2 runtime.support_bmi2
+var supportBMI2 bool
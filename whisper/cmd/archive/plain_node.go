@@ -1,3 +1,6 @@
+//go:build ignore
+// +build ignore
+
 package main
 
 import (
@@ -26,13 +29,18 @@ func main()  {
 
 	cfg := &wnode.DefaultConfig
 
-	// enode of boot mode
-	cfg.ArgEnode = "enode://c6fefcc64c1557d4df56a2f8c0dc3ae53f0ad31c82002848e500edcf00c71426dce424078e96eaf03656b81f9b8be4c8ed1438993524294a0f1ff6aef98d1ad2@127.0.0.1:30348"
+	// enode published by the boot node
+	cfg.ArgBootFrom = "./boot_archive_node.json"
 	cfg.ArgIDFile = IDFile
 
 	cfg.ArgTopic ="746f7031"
 	cfg.ArgSymPass = "123"
 
-	wnode.StartNode(cfg)
+	if _, err := wnode.LoadConfig(cfg, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if err := wnode.StartNode(cfg); err != nil {
+		log.Fatal(err)
+	}
 }
 
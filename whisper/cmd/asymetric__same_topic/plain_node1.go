@@ -1,3 +1,6 @@
+//go:build ignore
+// +build ignore
+
 package main
 
 import (
@@ -45,12 +48,17 @@ func main()  {
 	cfg.ArgPrivateKeyFile = PirvKeyFile
 	cfg.UseSelfPubKey = true
 
-	// enode of boot mode
-	cfg.ArgEnode = "enode://bab2d451dcead0ac4eadfda3be9f86eb62e8c2a2158d5a88689759c6d0a4152b3f5fa970095fc7c2a7655435ba9b5d9fdadd000f37f9db47e672973a27da9408@127.0.0.1:30348"
+	// enode published by the boot node
+	cfg.ArgBootFrom = "./boot_node.json"
 	cfg.ArgIDFile = IDFile
 
 	cfg.ArgTopic ="746f7031"
 
-	wnode.StartNode(cfg)
+	if _, err := wnode.LoadConfig(cfg, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if err := wnode.StartNode(cfg); err != nil {
+		log.Fatal(err)
+	}
 }
 
@@ -1,3 +1,6 @@
+//go:build ignore
+// +build ignore
+
 package main
 
 import (
@@ -49,7 +52,13 @@ func main() {
 	//cfg.ArgDBPath = "./db"
 	cfg.ArgTopic = "746f7031"
 	cfg.ArgIP = "127.0.0.1:30348"
+	cfg.ArgPublishFile = "./boot_node.json" // read by the plain nodes
 	cfg.ArgIDFile = IDFile
 
-	wnode.StartNode(cfg)
+	if _, err := wnode.LoadConfig(cfg, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if err := wnode.StartNode(cfg); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,173 @@
+package wnode
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Reasons a mail server refuses a request, sent back in the page marker.
+var (
+	errNotAllowed  = errors.New("requester is not allowed")
+	errRateLimited = errors.New("too many requests")
+)
+
+// MailRequestRecord is an entry of the request log of a mail server,
+// written as one line of JSON to Config.ArgMailLog.
+type MailRequestRecord struct {
+	Time      time.Time     `json:"time"`
+	Method    string        `json:"method,omitempty"`    // ArchiveAPI method, for the calls of other archive nodes
+	Peer      string        `json:"peer"`                // node ID of the peer the request came from, or IP of the caller of the ArchiveAPI
+	Requester hexutil.Bytes `json:"requester,omitempty"` // public key the request is signed with
+	From      uint32        `json:"from"`
+	To        uint32        `json:"to"`
+	Limit     uint32        `json:"limit,omitempty"`
+	Cursor    hexutil.Bytes `json:"cursor,omitempty"`
+	Delivered uint32        `json:"delivered"`         // envelopes sent
+	Refused   string        `json:"refused,omitempty"` // why the request was refused
+}
+
+// mailAccess authorizes the requests of a mail server, limits their rate
+// per peer and logs them.
+type mailAccess struct {
+	allowed map[string]bool // hex encoded public keys, anyone if nil
+	rate    float64         // requests per minute and peer, unlimited if 0
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket // by peer
+	file    *os.File                // request log, if any
+	enc     *json.Encoder
+	log     log.Logger
+}
+
+// tokenBucket holds the requests a peer may still send. It refills at the
+// rate of the mail server, up to one minute's worth.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newMailAccess(c *Config, logger log.Logger) (*mailAccess, error) {
+	a := &mailAccess{
+		rate:    float64(c.ArgMailRate),
+		buckets: make(map[string]*tokenBucket),
+		log:     logger,
+	}
+	if len(c.ArgMailAllow) > 0 {
+		keys, err := loadPublicKeys(c.ArgMailAllow)
+		if err != nil {
+			return nil, err
+		}
+		a.allowed = make(map[string]bool)
+		for _, k := range keys {
+			a.allowed[common.ToHex(crypto.FromECDSAPub(k))] = true
+		}
+	}
+	if len(c.ArgMailLog) > 0 {
+		f, err := os.OpenFile(c.ArgMailLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("open request log: %s", err)
+		}
+		a.file, a.enc = f, json.NewEncoder(f)
+	}
+	return a, nil
+}
+
+// loadPublicKeys reads a file of hex encoded public keys, one per line.
+// Empty lines and lines starting with # are skipped.
+func loadPublicKeys(path string) ([]*ecdsa.PublicKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []*ecdsa.PublicKey
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 || strings.HasPrefix(s, "#") {
+			continue
+		}
+		k := crypto.ToECDSAPub(common.FromHex(s))
+		if !isKeyValid(k) {
+			return nil, fmt.Errorf("%s:%d: invalid public key", path, line)
+		}
+		keys = append(keys, k)
+	}
+	return keys, scanner.Err()
+}
+
+// authorize decides whether peer may have a request signed by src served.
+func (a *mailAccess) authorize(peer string, src *ecdsa.PublicKey, now time.Time) error {
+	if a.allowed != nil && !a.allowed[common.ToHex(crypto.FromECDSAPub(src))] {
+		return errNotAllowed
+	}
+	if a.rate == 0 {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for p, b := range a.buckets {
+		// a bucket idle for a minute is full again, like a new one
+		if now.Sub(b.last) >= time.Minute {
+			delete(a.buckets, p)
+		}
+	}
+	b := a.buckets[peer]
+	if b == nil {
+		b = &tokenBucket{tokens: a.rate, last: now}
+		a.buckets[peer] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * a.rate
+	if b.tokens > a.rate {
+		b.tokens = a.rate
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return errRateLimited
+	}
+	b.tokens--
+	return nil
+}
+
+// record logs a request, to the request log if there is one.
+func (a *mailAccess) record(r *MailRequestRecord) {
+	ctx := []interface{}{"peer", r.Peer, "requester", r.Requester, "from", r.From, "to", r.To, "limit", r.Limit}
+	switch {
+	case len(r.Method) > 0 && len(r.Refused) > 0:
+		a.log.Info("archive call refused", append(ctx, "method", r.Method, "reason", r.Refused)...)
+	case len(r.Method) > 0:
+		a.log.Info("archive call served", append(ctx, "method", r.Method, "delivered", r.Delivered)...)
+	case len(r.Refused) > 0:
+		a.log.Info("mail request refused", append(ctx, "reason", r.Refused)...)
+	default:
+		a.log.Info("mail request served", append(ctx, "delivered", r.Delivered)...)
+	}
+	if a.enc == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(r); err != nil {
+		a.log.Error("failed to write the request log", "err", err)
+	}
+}
+
+func (a *mailAccess) close() {
+	if a.file != nil {
+		a.file.Close()
+	}
+}
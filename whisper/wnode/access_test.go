@@ -0,0 +1,157 @@
+package wnode
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// writeKeyFile writes the public keys of keys to a file in dir, in the
+// format of Config.ArgMailAllow.
+func writeKeyFile(t *testing.T, dir string, keys ...*ecdsa.PrivateKey) string {
+	lines := []string{"# allowed requesters", ""}
+	for _, k := range keys {
+		lines = append(lines, common.ToHex(crypto.FromECDSAPub(&k.PublicKey)))
+	}
+	path := filepath.Join(dir, "allow")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPublicKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, _ := crypto.GenerateKey()
+	b, _ := crypto.GenerateKey()
+
+	keys, err := loadPublicKeys(writeKeyFile(t, dir, a, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !whisper.IsPubKeyEqual(keys[0], &a.PublicKey) || !whisper.IsPubKeyEqual(keys[1], &b.PublicKey) {
+		t.Errorf("loaded %d keys, want those of a and b", len(keys))
+	}
+
+	path := filepath.Join(dir, "bad")
+	if err := ioutil.WriteFile(path, []byte("# comment\n0x0102\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPublicKeys(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("got %v, want an error for line 2", err)
+	}
+}
+
+func TestAuthorizeAllowlist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	allowed, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+
+	c := testConfig()
+	c.ArgMailAllow = writeKeyFile(t, dir, allowed)
+	a, err := newMailAccess(c, log.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+
+	now := time.Now()
+	if err := a.authorize("peer", &allowed.PublicKey, now); err != nil {
+		t.Errorf("allowed key refused: %v", err)
+	}
+	if err := a.authorize("peer", &other.PublicKey, now); err != errNotAllowed {
+		t.Errorf("other key: got %v, want errNotAllowed", err)
+	}
+}
+
+func TestAuthorizeRate(t *testing.T) {
+	c := testConfig()
+	c.ArgMailRate = 2
+	a, err := newMailAccess(c, log.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := crypto.GenerateKey()
+	src := &key.PublicKey
+
+	start := time.Unix(1000, 0)
+	steps := []struct {
+		peer  string
+		after time.Duration
+		want  error
+	}{
+		{"a", 0, nil},
+		{"a", 0, nil},
+		{"a", 0, errRateLimited},
+		{"b", 0, nil}, // every peer has its own bucket
+		{"a", 20 * time.Second, errRateLimited},
+		{"a", 30 * time.Second, nil}, // refilled one request in 30s
+		{"a", 30 * time.Second, errRateLimited},
+		{"a", 2 * time.Minute, nil}, // idle, full again
+		{"a", 2 * time.Minute, nil},
+		{"a", 2 * time.Minute, errRateLimited},
+	}
+	for i, s := range steps {
+		if err := a.authorize(s.peer, src, start.Add(s.after)); err != s.want {
+			t.Errorf("request %d of %s after %v: got %v, want %v", i, s.peer, s.after, err, s.want)
+		}
+	}
+}
+
+func TestRecordLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := testConfig()
+	c.ArgMailLog = filepath.Join(dir, "requests.jsonl")
+	a, err := newMailAccess(c, log.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(0); i < 3; i++ {
+		a.record(&MailRequestRecord{Peer: fmt.Sprint(i), From: i, To: i + 10, Delivered: i})
+	}
+	a.record(&MailRequestRecord{Peer: "refused", Refused: errNotAllowed.Error()})
+	a.close()
+
+	f, err := os.Open(c.ArgMailLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []MailRequestRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r MailRequestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %d: %v", len(records)+1, err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 4 || records[2].To != 12 || records[3].Refused != errNotAllowed.Error() {
+		t.Errorf("got records %+v", records)
+	}
+}
@@ -0,0 +1,274 @@
+package wnode
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+const (
+	// ackTimeout is how long a sender waits for the next acknowledgement
+	// before it retransmits the pieces that are not acknowledged yet.
+	ackTimeout = 5 * time.Second
+
+	// maxAckRanges and maxAckError bound an acknowledgement well within
+	// the transfer overhead, whatever the number of chunks of the file.
+	maxAckRanges = 48
+	maxAckError  = 256
+)
+
+// ack acknowledges the pieces of a file received so far. Like every
+// message sent by a node, it is signed with the node's key.
+type ack struct {
+	ID       transferID
+	Chunks   []chunkRange // chunks received, the lowest maxAckRanges runs of them
+	Complete bool         // file received and saved
+	Error    string       // why the received file could not be saved
+}
+
+// chunkRange is a run of chunks, from From up to but not including To.
+type chunkRange struct {
+	From, To uint32
+}
+
+// outgoing is a file sent that waits for acknowledgements.
+type outgoing struct {
+	// key acknowledgements must be signed with. A file sent with a
+	// symmetric key may reach anyone who holds the key, so the sender
+	// does not know the recipient's key; the first one to acknowledge
+	// the file is taken as the recipient, and acknowledgements signed
+	// by other keys are ignored from then on.
+	recipient *ecdsa.PublicKey
+	acks      chan *ack
+}
+
+// recipient returns the public key a message sent with opts is encrypted
+// with, or nil if it is encrypted symmetrically.
+func (n *Node) recipient(opts *SendOptions) *ecdsa.PublicKey {
+	if opts != nil {
+		if opts.PubKey != nil {
+			return opts.PubKey
+		}
+		if opts.SymKey != nil {
+			return nil
+		}
+	}
+	return n.pub
+}
+
+func (n *Node) expectAcks(id transferID, recipient *ecdsa.PublicKey) <-chan *ack {
+	out := &outgoing{recipient, make(chan *ack, 16)}
+	n.outMu.Lock()
+	n.outgoing[id] = out
+	n.outMu.Unlock()
+	return out.acks
+}
+
+func (n *Node) forgetAcks(id transferID) {
+	n.outMu.Lock()
+	delete(n.outgoing, id)
+	n.outMu.Unlock()
+}
+
+// awaitAcks retransmits the pieces of a file that are not acknowledged
+// until the receiver reports the file complete or ArgAckTime passes.
+func (n *Node) awaitAcks(ctx context.Context, id transferID, pieces [][]byte, opts *SendOptions, acks <-chan *ack) error {
+	deadline, cancel := context.WithTimeout(ctx, time.Duration(n.config.ArgAckTime)*time.Second)
+	defer cancel()
+
+	received := make(map[uint32]bool)
+	retry := time.NewTimer(ackTimeout)
+	defer retry.Stop()
+	for {
+		select {
+		case a := <-acks:
+			if len(a.Error) > 0 {
+				return &NetworkError{"send file", fmt.Errorf("receiver failed to save the file: %s", a.Error)}
+			}
+			if a.Complete {
+				return nil
+			}
+			for _, r := range a.Chunks {
+				for i := r.From; i < r.To && i < uint32(len(pieces)); i++ {
+					received[i] = true
+				}
+			}
+			if !retry.Stop() {
+				<-retry.C
+			}
+			retry.Reset(ackTimeout)
+		case <-retry.C:
+			// the manifest is always resent, in case it was lost
+			which := []int{0}
+			for i := 1; i < len(pieces); i++ {
+				if !received[uint32(i-1)] {
+					which = append(which, i)
+				}
+			}
+			n.log.Debug("retransmitting file pieces", "transfer", fmt.Sprintf("%x", id), "pieces", len(which))
+			if _, err := n.sendPieces(deadline, pieces, which, opts); err != nil && deadline.Err() == nil {
+				return err
+			}
+			retry.Reset(ackTimeout)
+		case <-deadline.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return &NetworkError{"send file", ErrNotAcknowledged}
+		}
+	}
+}
+
+// receiveAck passes an acknowledgement on to the sender waiting for it.
+func (n *Node) receiveAck(msg *whisper.ReceivedMessage, body []byte) {
+	var a ack
+	if err := rlp.DecodeBytes(body, &a); err != nil {
+		n.log.Warn("invalid acknowledgement", "hash", msg.EnvelopeHash.Hex(), "err", err)
+		return
+	}
+
+	if n.fromSelf(msg) {
+		return
+	}
+	n.outMu.Lock()
+	out := n.outgoing[a.ID]
+	signed := out != nil && msg.Src != nil
+	if signed && out.recipient == nil {
+		out.recipient = msg.Src
+	}
+	signed = signed && whisper.IsPubKeyEqual(msg.Src, out.recipient)
+	n.outMu.Unlock()
+	if out == nil {
+		return
+	}
+	if !signed {
+		n.log.Warn("acknowledgement not signed by the recipient", "transfer", fmt.Sprintf("%x", a.ID))
+		return
+	}
+	select {
+	case out.acks <- &a:
+	default:
+		// acknowledgements are cumulative, a later one makes up for it
+	}
+}
+
+// acknowledge sends the receiver's acknowledgement of transfer t to its
+// sender in the background, so the message loop is not held up by the
+// proof of work. Only one acknowledgement of a transfer is sent at a time:
+// while one is being sealed, t stays pending and a later sweep sends the
+// state of then. Stopping the node gives up the acknowledgement.
+func (n *Node) acknowledge(id transferID, t *transfer) {
+	if !t.ack {
+		t.pending = false
+		return
+	}
+	if t.reply == nil {
+		t.pending = false
+		n.log.Warn("can not acknowledge unsigned file", "transfer", fmt.Sprintf("%x", id))
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&t.acking, 0, 1) {
+		return
+	}
+	t.pending = false
+
+	a := &ack{ID: id, Complete: t.done && t.failure == nil}
+	if t.failure != nil {
+		a.Error = t.failure.Error()
+		if len(a.Error) > maxAckError {
+			a.Error = a.Error[:maxAckError]
+		}
+	}
+	if !a.Complete {
+		a.Chunks = chunkRanges(t.chunks, maxAckRanges)
+	}
+
+	payload, err := encodeFrame(frameAck, a)
+	if err != nil {
+		atomic.StoreUint32(&t.acking, 0)
+		n.log.Warn("failed to encode acknowledgement", "err", err)
+		return
+	}
+	reply := t.reply
+	go func() {
+		defer atomic.StoreUint32(&t.acking, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-n.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if _, err := n.Send(ctx, payload, reply); err != nil {
+			n.log.Warn("failed to send acknowledgement", "transfer", fmt.Sprintf("%x", id), "err", err)
+		}
+	}()
+}
+
+// chunkRanges returns the lowest max runs of the chunks received. Chunks
+// beyond them are left out; the sender retransmits them, and the receiver
+// ignores the duplicates.
+func chunkRanges(chunks map[uint32][]byte, max int) []chunkRange {
+	indexes := make([]uint32, 0, len(chunks))
+	for i := range chunks {
+		indexes = append(indexes, i)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	var ranges []chunkRange
+	for _, i := range indexes {
+		if last := len(ranges) - 1; last >= 0 && ranges[last].To == i {
+			ranges[last].To++
+			continue
+		}
+		if len(ranges) == max {
+			break
+		}
+		ranges = append(ranges, chunkRange{i, i + 1})
+	}
+	return ranges
+}
+
+// acknowledgePending acknowledges the transfers that received pieces since
+// their last acknowledgement.
+func (n *Node) acknowledgePending() {
+	for id, t := range n.transfers {
+		if t.pending {
+			n.acknowledge(id, t)
+		}
+	}
+}
+
+// replyOptions returns how to reach the sender of msg: with the symmetric
+// key of the subscription that received it, else with the sender's public
+// key. It returns nil if msg is neither symmetric nor signed.
+func (n *Node) replyOptions(msg *whisper.ReceivedMessage, subscription string) *SendOptions {
+	n.subsMu.RLock()
+	s := n.subs[subscription]
+	n.subsMu.RUnlock()
+
+	topic := msg.Topic
+	opts := &SendOptions{Topic: &topic}
+	switch {
+	case s != nil && s.filter.KeySym != nil:
+		opts.SymKey = s.filter.KeySym
+	case msg.Src != nil:
+		opts.PubKey = msg.Src
+	default:
+		return nil
+	}
+	return opts
+}
+
+// fromSelf reports whether msg was signed by this node.
+func (n *Node) fromSelf(msg *whisper.ReceivedMessage) bool {
+	return whisper.IsPubKeyEqual(msg.Src, &n.asymKey.PublicKey)
+}
@@ -0,0 +1,127 @@
+package wnode
+
+import (
+	"crypto/ecdsa"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+func TestChunkRanges(t *testing.T) {
+	chunks := make(map[uint32][]byte)
+	for _, i := range []uint32{0, 1, 2, 5, 7, 8} {
+		chunks[i] = nil
+	}
+	want := []chunkRange{{0, 3}, {5, 6}, {7, 9}}
+	if got := chunkRanges(chunks, maxAckRanges); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := chunkRanges(chunks, 2); !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("capped: got %v, want %v", got, want[:2])
+	}
+}
+
+func TestAckSize(t *testing.T) {
+	// every other chunk of a large file, the worst case for ranges
+	chunks := make(map[uint32][]byte)
+	for i := uint32(0); i < 1<<20; i += 2 {
+		chunks[i+1<<31] = nil
+	}
+	long := make([]byte, 4*maxAckError)
+	a := &ack{
+		ID:     transferID{1},
+		Chunks: chunkRanges(chunks, maxAckRanges),
+		Error:  string(long[:maxAckError]),
+	}
+	payload, err := encodeFrame(frameAck, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) > transferOverhead {
+		t.Errorf("acknowledgement of %d bytes exceeds %d", len(payload), transferOverhead)
+	}
+}
+
+func TestReceiveAckSigner(t *testing.T) {
+	n := NewNode(testConfig())
+	n.outgoing = make(map[transferID]*outgoing)
+	self, _ := crypto.GenerateKey()
+	recipient, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	n.asymKey = self
+
+	receive := func(id transferID, from *ecdsa.PrivateKey) {
+		body, err := rlp.EncodeToBytes(&ack{ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.receiveAck(&whisper.ReceivedMessage{Src: &from.PublicKey}, body)
+	}
+	received := func(acks <-chan *ack) int {
+		count := 0
+		for {
+			select {
+			case <-acks:
+				count++
+			default:
+				return count
+			}
+		}
+	}
+
+	// asymmetric: only the recipient acknowledges
+	asym := n.expectAcks(transferID{1}, &recipient.PublicKey)
+	receive(transferID{1}, other)
+	receive(transferID{1}, self)
+	receive(transferID{1}, recipient)
+	if got := received(asym); got != 1 {
+		t.Errorf("asymmetric: %d acknowledgements passed, want 1", got)
+	}
+
+	// symmetric: the first signer becomes the recipient
+	sym := n.expectAcks(transferID{2}, nil)
+	receive(transferID{2}, recipient)
+	receive(transferID{2}, other)
+	receive(transferID{2}, recipient)
+	if got := received(sym); got != 2 {
+		t.Errorf("symmetric: %d acknowledgements passed, want 2", got)
+	}
+}
+
+func TestAcknowledgeOneAtATime(t *testing.T) {
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+
+	// a PoW target out of reach keeps the acknowledgement sealing for the
+	// whole work time
+	id := transferID{1}
+	tr := &transfer{
+		chunks:  map[uint32][]byte{0: nil},
+		ack:     true,
+		reply:   &SendOptions{SymKey: n.SymKey(), PoW: 1000, WorkTime: 3},
+		pending: true,
+	}
+	n.acknowledge(id, tr)
+	if tr.pending || atomic.LoadUint32(&tr.acking) != 1 {
+		t.Fatalf("first acknowledgement not sent: pending %v", tr.pending)
+	}
+
+	// more pieces arrive, but the acknowledgement waits for the first one
+	tr.chunks[1], tr.pending = nil, true
+	n.acknowledge(id, tr)
+	if !tr.pending {
+		t.Error("second acknowledgement sent while the first is sealed")
+	}
+
+	n.Stop()
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint32(&tr.acking) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("acknowledgement not given up when the node stopped")
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package wnode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rpc"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// rpcNamespace prefixes the names of the API methods, e.g. wnode_post.
+const rpcNamespace = "wnode"
+
+// rpcVirtualHosts are the host names accepted in the Host header of API
+// requests. Requests addressed to an IP are always accepted; the API is
+// meant for tools running on the same machine.
+var rpcVirtualHosts = []string{"localhost"}
+
+// rpcServer serves a node's PublicAPI as JSON-RPC over HTTP and WebSocket.
+type rpcServer struct {
+	rpc     *rpc.Server
+	http    *http.Server
+	ws      *http.Server
+	httpURL string
+	wsURL   string
+	unwatch func()
+}
+
+func (n *Node) startRPC() error {
+	api := newPublicAPI(n)
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(rpcNamespace, api); err != nil {
+		return &NetworkError{"start rpc", err}
+	}
+	s := &rpcServer{rpc: srv, unwatch: n.watch(api.queue)}
+
+	if len(n.config.ArgRPCAddr) > 0 {
+		s.http = rpc.NewHTTPServer(nil, rpcVirtualHosts, srv)
+		addr, err := serve(s.http, n.config.ArgRPCAddr)
+		if err != nil {
+			s.stop()
+			return &NetworkError{"start rpc", err}
+		}
+		s.httpURL = "http://" + addr
+		n.log.Info("JSON-RPC API listening", "url", s.httpURL)
+		if n.interactive {
+			fmt.Printf("JSON-RPC API listening on %s \n", s.httpURL)
+		}
+	}
+	if len(n.config.ArgWSAddr) > 0 {
+		s.ws = &http.Server{Handler: srv.WebsocketHandler(splitList(n.config.ArgWSOrigins))}
+		addr, err := serve(s.ws, n.config.ArgWSAddr)
+		if err != nil {
+			s.stop()
+			return &NetworkError{"start websocket", err}
+		}
+		s.wsURL = "ws://" + addr
+		n.log.Info("WebSocket API listening", "url", s.wsURL)
+		if n.interactive {
+			fmt.Printf("WebSocket API listening on %s \n", s.wsURL)
+		}
+	}
+	n.rpc = s
+	return nil
+}
+
+// serve listens on addr and serves s in the background. It returns the
+// address actually listened on, which differs from addr if its port is 0.
+func serve(s *http.Server, addr string) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	go s.Serve(l)
+	return l.Addr().String(), nil
+}
+
+func (s *rpcServer) stop() {
+	s.unwatch()
+	for _, h := range []*http.Server{s.http, s.ws} {
+		if h != nil {
+			h.Close()
+		}
+	}
+	s.rpc.Stop()
+}
+
+// RPCURL returns the URL of the JSON-RPC API over HTTP, or an empty string
+// if it is disabled.
+func (n *Node) RPCURL() string {
+	if n.rpc == nil {
+		return ""
+	}
+	return n.rpc.httpURL
+}
+
+// WSURL returns the URL of the JSON-RPC API over WebSocket, or an empty
+// string if it is disabled.
+func (n *Node) WSURL() string {
+	if n.rpc == nil {
+		return ""
+	}
+	return n.rpc.wsURL
+}
+
+// PublicAPI is the JSON-RPC API of a node. Received messages are queued per
+// subscription until a client fetches them with GetMessages; every queue
+// holds up to Config.ArgBufferSize messages and discards the oldest ones
+// when it is full.
+type PublicAPI struct {
+	n *Node
+
+	mu     sync.Mutex
+	queues map[string][]*RPCMessage
+}
+
+func newPublicAPI(n *Node) *PublicAPI {
+	return &PublicAPI{n: n, queues: make(map[string][]*RPCMessage)}
+}
+
+// RPCMessage is the JSON form of a received Message.
+type RPCMessage struct {
+	Hash         common.Hash       `json:"hash"`
+	Subscription string            `json:"subscription"`
+	Topic        whisper.TopicType `json:"topic"`
+	Sender       *common.Address   `json:"sender,omitempty"`
+	SenderKey    hexutil.Bytes     `json:"senderKey,omitempty"`
+	Sent         uint64            `json:"sent"`
+	TTL          uint32            `json:"ttl"`
+	PoW          float64           `json:"pow"`
+	Payload      hexutil.Bytes     `json:"payload"`
+}
+
+func newRPCMessage(m *Message) *RPCMessage {
+	msg := &RPCMessage{
+		Hash:         m.Hash,
+		Subscription: m.Subscription,
+		Topic:        m.Topic,
+		Sent:         uint64(m.Sent.Unix()),
+		TTL:          m.TTL,
+		PoW:          m.PoW,
+		Payload:      m.Payload,
+	}
+	if m.SenderKey != nil {
+		sender := m.Sender
+		msg.Sender = &sender
+		msg.SenderKey = crypto.FromECDSAPub(m.SenderKey)
+	}
+	return msg
+}
+
+func (api *PublicAPI) queue(m *Message) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	q := append(api.queues[m.Subscription], newRPCMessage(m))
+	if over := len(q) - api.n.config.ArgBufferSize; over > 0 {
+		q = q[over:]
+	}
+	api.queues[m.Subscription] = q
+}
+
+// NodeInfo describes the node.
+type NodeInfo struct {
+	Enode     string              `json:"enode"`
+	PublicKey hexutil.Bytes       `json:"publicKey"`
+	Topics    []whisper.TopicType `json:"topics"`
+}
+
+// Info returns the node's enode, public key and default topics.
+func (api *PublicAPI) Info() NodeInfo {
+	return api.n.Info()
+}
+
+// Peers returns the connected peers.
+func (api *PublicAPI) Peers() []*p2p.PeerInfo {
+	return api.n.server.PeersInfo()
+}
+
+// StaticPeers returns the peers the node keeps connected to, connected or
+// not.
+func (api *PublicAPI) StaticPeers() []*PeerStatus {
+	return api.n.StaticPeers()
+}
+
+// AddPeer makes the node keep connected to the peer with the given enode,
+// across restarts if the node has a peers file.
+func (api *PublicAPI) AddPeer(enode string) error {
+	return api.n.AddPeer(enode)
+}
+
+// RemovePeer disconnects the peer with the given enode and stops keeping
+// it connected.
+func (api *PublicAPI) RemovePeer(enode string) error {
+	return api.n.RemovePeer(enode)
+}
+
+// PostArgs describe a message to send. Unset fields fall back to the node
+// defaults, as with SendOptions.
+type PostArgs struct {
+	Topic    *whisper.TopicType `json:"topic"`
+	SymKeyID string             `json:"symKeyID"` // ID of the symmetric key to encrypt with
+	PubKey   hexutil.Bytes      `json:"pubKey"`   // public key of the recipient to encrypt with
+	TTL      uint32             `json:"ttl"`
+	PoW      float64            `json:"pow"`
+	WorkTime uint32             `json:"workTime"`
+	Payload  hexutil.Bytes      `json:"payload"`
+}
+
+// Post sends a message and returns the hash of its envelope.
+func (api *PublicAPI) Post(ctx context.Context, args PostArgs) (common.Hash, error) {
+	opts := &SendOptions{
+		Topic:    args.Topic,
+		TTL:      args.TTL,
+		PoW:      args.PoW,
+		WorkTime: args.WorkTime,
+	}
+	if len(args.SymKeyID) > 0 {
+		key, err := api.n.shh.GetSymKey(args.SymKeyID)
+		if err != nil {
+			return common.Hash{}, &KeyError{args.SymKeyID, err}
+		}
+		opts.SymKey = key
+	}
+	if len(args.PubKey) > 0 {
+		opts.PubKey = crypto.ToECDSAPub(args.PubKey)
+		if !isKeyValid(opts.PubKey) {
+			return common.Hash{}, &KeyError{"pubKey", errors.New("invalid public key")}
+		}
+	}
+	return api.n.Send(ctx, args.Payload, opts)
+}
+
+// SubscribeArgs describe a subscription to install. Exactly one of SymKeyID,
+// PrivateKeyID and SymPass must be set.
+type SubscribeArgs struct {
+	Name         string              `json:"name"`
+	Topics       []whisper.TopicType `json:"topics"`
+	SymKeyID     string              `json:"symKeyID"`
+	PrivateKeyID string              `json:"privateKeyID"`
+	SymPass      string              `json:"symPass"`
+	AllowP2P     bool                `json:"allowP2P"`
+	MinPoW       float64             `json:"minPoW"`
+}
+
+// NewSubscription installs a subscription, see Node.Subscribe. (Methods
+// named subscribe are reserved for notifications by the rpc package.)
+func (api *PublicAPI) NewSubscription(args SubscribeArgs) error {
+	cfg := SubscriptionConfig{
+		Topics:   args.Topics,
+		SymPass:  args.SymPass,
+		AllowP2P: args.AllowP2P,
+		MinPoW:   args.MinPoW,
+	}
+	var err error
+	if len(args.SymKeyID) > 0 {
+		if cfg.SymKey, err = api.n.shh.GetSymKey(args.SymKeyID); err != nil {
+			return &KeyError{args.SymKeyID, err}
+		}
+	}
+	if len(args.PrivateKeyID) > 0 {
+		if cfg.PrivateKey, err = api.n.shh.GetPrivateKey(args.PrivateKeyID); err != nil {
+			return &KeyError{args.PrivateKeyID, err}
+		}
+	}
+	return api.n.Subscribe(args.Name, cfg)
+}
+
+// DeleteSubscription removes a subscription and discards its queued messages.
+func (api *PublicAPI) DeleteSubscription(name string) error {
+	if err := api.n.Unsubscribe(name); err != nil {
+		return err
+	}
+	api.mu.Lock()
+	delete(api.queues, name)
+	api.mu.Unlock()
+	return nil
+}
+
+// Subscriptions returns the names of the installed subscriptions.
+func (api *PublicAPI) Subscriptions() []string {
+	return api.n.Subscriptions()
+}
+
+// GetMessages returns the messages received by the named subscription since
+// the previous call.
+func (api *PublicAPI) GetMessages(name string) []*RPCMessage {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	q := api.queues[name]
+	delete(api.queues, name)
+	if q == nil {
+		return []*RPCMessage{}
+	}
+	return q
+}
+
+// NewKeyPair generates a key pair and returns its ID.
+func (api *PublicAPI) NewKeyPair() (string, error) {
+	return api.n.shh.NewKeyPair()
+}
+
+// AddPrivateKey imports a private key and returns its ID.
+func (api *PublicAPI) AddPrivateKey(key hexutil.Bytes) (string, error) {
+	k, err := crypto.ToECDSA(key)
+	if err != nil {
+		return "", &KeyError{"private key", err}
+	}
+	return api.n.shh.AddKeyPair(k)
+}
+
+// GetPublicKey returns the public key of the key pair with the given ID.
+func (api *PublicAPI) GetPublicKey(id string) (hexutil.Bytes, error) {
+	k, err := api.n.shh.GetPrivateKey(id)
+	if err != nil {
+		return nil, &KeyError{id, err}
+	}
+	return crypto.FromECDSAPub(&k.PublicKey), nil
+}
+
+// DeleteKeyPair removes the key pair with the given ID.
+func (api *PublicAPI) DeleteKeyPair(id string) bool {
+	return api.n.shh.DeleteKeyPair(id)
+}
+
+// NewSymKey generates a symmetric key and returns its ID.
+func (api *PublicAPI) NewSymKey() (string, error) {
+	return api.n.shh.GenerateSymKey()
+}
+
+// AddSymKey imports a symmetric key and returns its ID.
+func (api *PublicAPI) AddSymKey(key hexutil.Bytes) (string, error) {
+	return api.n.shh.AddSymKeyDirect(key)
+}
+
+// GenerateSymKeyFromPassword derives a symmetric key from the password and
+// returns its ID.
+func (api *PublicAPI) GenerateSymKeyFromPassword(password string) (string, error) {
+	return api.n.shh.AddSymKeyFromPassword(password)
+}
+
+// DeleteSymKey removes the symmetric key with the given ID.
+func (api *PublicAPI) DeleteSymKey(id string) bool {
+	return api.n.shh.DeleteSymKey(id)
+}
+
+// HistoryArgs describe a request for a page of archived messages.
+type HistoryArgs struct {
+	Peer     string              `json:"peer"`     // enode of the mail server, the first of Config.ArgEnode if empty
+	Password string              `json:"password"` // mail server password, the node's if empty
+	From     uint32              `json:"from"`     // unix time
+	To       uint32              `json:"to"`       // unix time, no upper limit if zero
+	Topics   []whisper.TopicType `json:"topics"`   // all topics if empty
+	Limit    uint32              `json:"limit"`    // messages per page, as many as the mail server allows if zero
+	Cursor   hexutil.Bytes       `json:"cursor"`   // cursor of the previous page, the first page if empty
+	Timeout  uint32              `json:"timeout"`  // seconds, Config.ArgMailTimeout if zero
+}
+
+// HistoryResult holds a page of messages delivered by a mail server.
+type HistoryResult struct {
+	Messages []*RPCMessage `json:"messages"`
+	Cursor   hexutil.Bytes `json:"cursor"`   // where the next page starts, null after the last page
+	Complete bool          `json:"complete"` // false if the page timed out
+}
+
+// RequestHistory asks a mail server for a page of archived messages and
+// returns them once the page is complete or the timeout expires. Further
+// pages are requested with the returned cursor.
+func (api *PublicAPI) RequestHistory(ctx context.Context, args HistoryArgs) (*HistoryResult, error) {
+	peer := args.Peer
+	if len(peer) == 0 {
+		peer = api.n.config.mailServerEnode()
+	}
+	password := args.Password
+	if len(password) == 0 {
+		password = api.n.msPassword
+	}
+	timeout := time.Duration(args.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = time.Duration(api.n.config.ArgMailTimeout) * time.Second
+	}
+	if timeout <= 0 {
+		return nil, &ConfigError{"timeout", errors.New("must be positive")}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	q := HistoryQuery{From: args.From, To: args.To, Topics: args.Topics, Limit: args.Limit, Cursor: args.Cursor}
+	page, err := api.n.requestHistory(ctx, peer, password, q, false)
+	if page == nil {
+		return nil, err
+	}
+	result := &HistoryResult{
+		Messages: make([]*RPCMessage, len(page.Messages)),
+		Cursor:   page.Cursor,
+		Complete: err == nil,
+	}
+	for i, m := range page.Messages {
+		result.Messages[i] = newRPCMessage(m)
+	}
+	if merr, ok := err.(*MailServerError); ok && merr.Err == context.DeadlineExceeded {
+		err = nil
+	}
+	return result, err
+}
@@ -0,0 +1,147 @@
+package wnode
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// startTestAPI starts a standalone node serving the API on a free port of
+// localhost, and returns a client of it.
+func startTestAPI(t *testing.T) (*Node, *rpc.Client) {
+	c := testConfig()
+	c.BootstrapMode = true
+	c.ArgIP = "127.0.0.1:0"
+	c.ArgRPCAddr = "127.0.0.1:0"
+	n := NewNode(c)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start the node: %v", err)
+	}
+	client, err := rpc.Dial(n.RPCURL())
+	if err != nil {
+		n.Stop()
+		t.Fatalf("failed to dial %s: %v", n.RPCURL(), err)
+	}
+	return n, client
+}
+
+func TestAPIPostAndPoll(t *testing.T) {
+	n, client := startTestAPI(t)
+	defer n.Stop()
+	defer client.Close()
+
+	var keyID string
+	if err := client.Call(&keyID, "wnode_newSymKey"); err != nil {
+		t.Fatalf("newSymKey failed: %v", err)
+	}
+	topic := whisper.BytesToTopic([]byte("poll"))
+	sub := SubscribeArgs{Name: "api", Topics: []whisper.TopicType{topic}, SymKeyID: keyID}
+	if err := client.Call(nil, "wnode_newSubscription", sub); err != nil {
+		t.Fatalf("newSubscription failed: %v", err)
+	}
+	var names []string
+	if err := client.Call(&names, "wnode_subscriptions"); err != nil {
+		t.Fatalf("subscriptions failed: %v", err)
+	}
+	found := false
+	for _, name := range names {
+		found = found || name == "api"
+	}
+	if !found {
+		t.Fatalf("subscription api not in %v", names)
+	}
+
+	payload := hexutil.Bytes("over localhost")
+	post := PostArgs{Topic: &topic, SymKeyID: keyID, Payload: payload}
+	var hash string
+	if err := client.Call(&hash, "wnode_post", post); err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var msgs []*RPCMessage
+		if err := client.Call(&msgs, "wnode_getMessages", "api"); err != nil {
+			t.Fatalf("getMessages failed: %v", err)
+		}
+		if len(msgs) > 0 {
+			if !bytes.Equal(msgs[0].Payload, payload) || msgs[0].Topic != topic || msgs[0].Hash.Hex() != hash {
+				t.Fatalf("got message %+v, want payload %q in %s", msgs[0], payload, hash)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("posted message was not received")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := client.Call(nil, "wnode_deleteSubscription", "api"); err != nil {
+		t.Fatalf("deleteSubscription failed: %v", err)
+	}
+	if err := client.Call(nil, "wnode_deleteSubscription", "api"); err == nil {
+		t.Error("deleted subscription could be deleted again")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	n, client := startTestAPI(t)
+	defer n.Stop()
+	defer client.Close()
+
+	var pairID string
+	if err := client.Call(&pairID, "wnode_newKeyPair"); err != nil {
+		t.Fatalf("newKeyPair failed: %v", err)
+	}
+	var pub hexutil.Bytes
+	if err := client.Call(&pub, "wnode_getPublicKey", pairID); err != nil {
+		t.Fatalf("getPublicKey failed: %v", err)
+	}
+	if len(pub) != 65 {
+		t.Errorf("public key has %d bytes, want 65", len(pub))
+	}
+	var deleted bool
+	if err := client.Call(&deleted, "wnode_deleteKeyPair", pairID); err != nil || !deleted {
+		t.Fatalf("deleteKeyPair: %v, %v", deleted, err)
+	}
+	if err := client.Call(&pub, "wnode_getPublicKey", pairID); err == nil {
+		t.Error("public key of a deleted key pair")
+	}
+
+	var symID string
+	key := hexutil.Bytes(bytes.Repeat([]byte{7}, 32))
+	if err := client.Call(&symID, "wnode_addSymKey", key); err != nil {
+		t.Fatalf("addSymKey failed: %v", err)
+	}
+	if err := client.Call(&deleted, "wnode_deleteSymKey", symID); err != nil || !deleted {
+		t.Fatalf("deleteSymKey: %v, %v", deleted, err)
+	}
+	if err := client.Call(&deleted, "wnode_deleteSymKey", symID); err != nil || deleted {
+		t.Errorf("deleted symmetric key deleted again: %v, %v", deleted, err)
+	}
+
+	var id string
+	if err := client.Call(&id, "wnode_addPrivateKey", hexutil.Bytes{1, 2, 3}); err == nil {
+		t.Error("invalid private key was added")
+	}
+}
+
+func TestAPIRequestHistoryTimeout(t *testing.T) {
+	n, client := startTestAPI(t)
+	defer n.Stop()
+	defer client.Close()
+
+	// reachable only by calling the API directly: Validate rejects a zero
+	// ArgMailTimeout
+	n.config.ArgMailTimeout = 0
+	api := newPublicAPI(n)
+	_, err := api.RequestHistory(context.Background(), HistoryArgs{Peer: n.Enode()})
+	if cerr, ok := err.(*ConfigError); !ok || cerr.Field != "timeout" {
+		t.Errorf("got %v, want a ConfigError of the timeout", err)
+	}
+}
@@ -0,0 +1,174 @@
+package wnode
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// DecryptedMessage is a saved envelope decrypted by DecryptDir, written as
+// one line of JSON.
+type DecryptedMessage struct {
+	File         string             `json:"file"`             // path of the envelope file, relative to the directory
+	Hash         common.Hash        `json:"hash"`             // hash of the envelope
+	Subscription string             `json:"subscription"`     // subscription whose key opened the envelope
+	Sender       *common.Address    `json:"sender,omitempty"` // address of the signer, if the message is signed
+	Topic        *whisper.TopicType `json:"topic,omitempty"`  // topic, unless saved by an older version
+	Sent         *time.Time         `json:"sent,omitempty"`   // time the message was sent, unless saved by an older version
+	Payload      []byte             `json:"payload"`          // base64 encoded payload
+}
+
+// BatchSummary reports the outcome of DecryptDir.
+type BatchSummary struct {
+	Files     int               // envelope files found
+	Skipped   int               // other files, such as received files and their sidecars
+	Decrypted int               // files decrypted
+	Failed    map[string]string // reason by file, for the files that could not be opened
+}
+
+func (s *BatchSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "decrypted %d of %d files\n", s.Decrypted, s.Files)
+	if s.Skipped > 0 {
+		fmt.Fprintf(&b, "skipped %d files that are not envelopes\n", s.Skipped)
+	}
+	files := make([]string, 0, len(s.Failed))
+	for f := range s.Failed {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		fmt.Fprintf(&b, "could not open %s: %s\n", f, s.Failed[f])
+	}
+	return b.String()
+}
+
+// DecryptDir walks dir for envelopes saved by a node's ArgSaveDir, tries
+// to open each with the keys of all subscriptions and writes the messages
+// to w as JSON Lines, in the order of the file names. Envelopes are saved
+// under their hash, so other files, such as the files received along with
+// their .json sidecars, are skipped.
+func (n *Node) DecryptDir(dir string, w io.Writer) (*BatchSummary, error) {
+	subs := n.subscriptions()
+	sort.Slice(subs, func(i, j int) bool { return subs[i].name < subs[j].name })
+
+	summary := &BatchSummary{Failed: make(map[string]string)}
+	enc := json.NewEncoder(w)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			rel = path
+		}
+		if !isEnvelopeFile(path) {
+			summary.Skipped++
+			return nil
+		}
+		summary.Files++
+
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			summary.Failed[rel] = err.Error()
+			return nil
+		}
+		env, full := readEnvelope(raw)
+		var (
+			msg  *whisper.ReceivedMessage
+			name string
+		)
+		for _, s := range subs {
+			if msg = env.Open(s.filter); msg != nil {
+				name = s.name
+				break
+			}
+		}
+		if msg == nil {
+			summary.Failed[rel] = "no key opens it"
+			return nil
+		}
+
+		m := &DecryptedMessage{
+			File:         rel,
+			Hash:         msg.EnvelopeHash,
+			Subscription: name,
+			Payload:      msg.Payload,
+		}
+		if msg.Src != nil {
+			sender := crypto.PubkeyToAddress(*msg.Src)
+			m.Sender = &sender
+		}
+		if full {
+			sent := time.Unix(int64(msg.Sent), 0)
+			m.Topic, m.Sent = &msg.Topic, &sent
+		} else {
+			// older versions saved the envelope data only, named after the hash
+			h, _ := hex.DecodeString(fi.Name())
+			m.Hash = common.BytesToHash(h)
+		}
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+		summary.Decrypted++
+		return nil
+	})
+	return summary, err
+}
+
+// isEnvelopeFile reports whether path is named like an envelope saved by
+// writeMessageToFile. A received file may happen to be named so, but it
+// has a sidecar.
+func isEnvelopeFile(path string) bool {
+	h, err := hex.DecodeString(filepath.Base(path))
+	if err != nil || len(h) != common.HashLength {
+		return false
+	}
+	_, err = os.Stat(path + ".json")
+	return os.IsNotExist(err)
+}
+
+// readEnvelope decodes an envelope saved by writeMessageToFile. Older
+// versions saved just the encrypted data of the envelope; for those it
+// returns an envelope with the data only and reports false.
+func readEnvelope(raw []byte) (env *whisper.Envelope, full bool) {
+	env = new(whisper.Envelope)
+	if err := rlp.DecodeBytes(raw, env); err == nil && len(env.Data) > 0 {
+		return env, true
+	}
+	return &whisper.Envelope{Data: raw}, false
+}
+
+// decryptBatch decrypts ArgBatchDir into ArgBatchOut and prints the summary.
+func (n *Node) decryptBatch() error {
+	w := io.Writer(os.Stdout)
+	if len(n.config.ArgBatchOut) > 0 {
+		f, err := os.Create(n.config.ArgBatchOut)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	summary, err := n.DecryptDir(n.config.ArgBatchDir, w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stderr, summary)
+	return nil
+}
@@ -0,0 +1,163 @@
+package wnode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+func TestDecryptDirSkipsReceivedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash := strings.Repeat("ab", 32)
+	files := map[string]string{
+		"report.pdf":                       "received file",
+		"report.pdf.json":                  "{}",
+		hash:                               "not an envelope",
+		strings.Repeat("cd", 32):           "received file named like an envelope",
+		strings.Repeat("cd", 32) + ".json": "{}",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := NewNode(testConfig())
+	summary, err := n.DecryptDir(dir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Files != 1 || summary.Skipped != 4 {
+		t.Errorf("got %d envelope files and %d skipped, want 1 and 4", summary.Files, summary.Skipped)
+	}
+	if _, ok := summary.Failed[hash]; !ok || len(summary.Failed) != 1 {
+		t.Errorf("failures %v, want %s only", summary.Failed, hash)
+	}
+}
+
+// sealTestEnvelope seals payload signed by signer, for the symmetric key
+// symKey or else for the public key dst.
+func sealTestEnvelope(t *testing.T, payload []byte, signer *ecdsa.PrivateKey, symKey []byte, dst *ecdsa.PublicKey) *whisper.Envelope {
+	params := &whisper.MessageParams{
+		Src:      signer,
+		Dst:      dst,
+		KeySym:   symKey,
+		Topic:    whisper.BytesToTopic([]byte("test")),
+		Payload:  payload,
+		TTL:      60,
+		PoW:      0.001,
+		WorkTime: 1,
+	}
+	msg, err := whisper.NewSentMessage(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestDecryptDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+	signer, _ := crypto.GenerateKey()
+	other := make([]byte, 32)
+	other[0] = 1
+
+	sym := sealTestEnvelope(t, []byte("symmetric"), signer, n.SymKey(), nil)
+	asym := sealTestEnvelope(t, []byte("asymmetric"), signer, nil, n.PublicKey())
+	legacy := sealTestEnvelope(t, []byte("legacy"), nil, n.SymKey(), nil)
+	foreign := sealTestEnvelope(t, []byte("foreign"), signer, other, nil)
+	write := func(env *whisper.Envelope, data []byte) string {
+		name := fmt.Sprintf("%x", env.Hash())
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	for _, env := range []*whisper.Envelope{sym, asym, foreign} {
+		raw, err := rlp.EncodeToBytes(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(env, raw)
+	}
+	// older versions saved the data of the envelope only
+	write(legacy, legacy.Data)
+
+	var out bytes.Buffer
+	summary, err := n.DecryptDir(dir, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreignName := fmt.Sprintf("%x", foreign.Hash())
+	if summary.Files != 4 || summary.Decrypted != 3 || len(summary.Failed) != 1 || summary.Failed[foreignName] != "no key opens it" {
+		t.Errorf("summary %+v, want %s failed only", summary, foreignName)
+	}
+
+	got := make(map[common.Hash]*DecryptedMessage)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		m := new(DecryptedMessage)
+		if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+			t.Fatalf("invalid line %s: %v", scanner.Text(), err)
+		}
+		got[m.Hash] = m
+	}
+
+	sender := crypto.PubkeyToAddress(signer.PublicKey)
+	topic := whisper.BytesToTopic([]byte("test"))
+	for _, want := range []struct {
+		env          *whisper.Envelope
+		subscription string
+		payload      string
+	}{
+		{sym, DefaultSymSubscription, "symmetric"},
+		{asym, DefaultAsymSubscription, "asymmetric"},
+	} {
+		m := got[want.env.Hash()]
+		if m == nil {
+			t.Errorf("%s message missing", want.payload)
+			continue
+		}
+		sent := time.Unix(int64(want.env.Expiry-want.env.TTL), 0)
+		if m.File != fmt.Sprintf("%x", want.env.Hash()) || m.Subscription != want.subscription || string(m.Payload) != want.payload {
+			t.Errorf("%s message: file %s, subscription %s, payload %q", want.payload, m.File, m.Subscription, m.Payload)
+		}
+		if m.Sender == nil || *m.Sender != sender || m.Topic == nil || *m.Topic != topic || m.Sent == nil || !m.Sent.Equal(sent) {
+			t.Errorf("%s message: sender %v, topic %v, sent %v", want.payload, m.Sender, m.Topic, m.Sent)
+		}
+	}
+
+	// the legacy file has no topic nor time, its hash is its name
+	if m := got[legacy.Hash()]; m == nil {
+		t.Error("legacy message missing")
+	} else if string(m.Payload) != "legacy" || m.Subscription != DefaultSymSubscription || m.Sender != nil || m.Topic != nil || m.Sent != nil {
+		t.Errorf("legacy message %+v", m)
+	}
+}
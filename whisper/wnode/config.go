@@ -3,67 +3,161 @@ package wnode
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/vidmed/logger"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/whisper/whisperv6"
 )
 
 type Config struct {
-	BootstrapMode  bool // boostrap node: don't initiate connection to peers, just wait for incoming connections
-	ForwarderMode  bool // forwarder mode: only forward messages, neither encrypt nor decrypt messages
-	MailServerMode bool // mail server mode: delivers expired messages on demand
-	RequestMail    bool // request expired messages from the bootstrap server
-	AsymmetricMode bool // use asymmetric encryption
-	GenerateKey    bool // generate and show the private key
-	FileExMode     bool // file exchange mode
-	FileReader     bool // load and decrypt messages saved as files, display as plain text
-	TestMode       bool // use of predefined parameters for diagnostics (password, etc.)
-	EchoMode       bool // echo mode: prints some arguments for diagnostics
-
-	ArgVerbosity int     // log verbosity level
-	ArgTTL       uint    // time-to-live for messages in seconds
-	ArgWorkTime  uint    // work time in seconds
-	ArgMaxSize   uint    // max size of message
-	ArgPoW       float64 // PoW for normal messages in float format (e.g. 2.7)
-	ArgServerPoW float64 // PoW requirement for Mail Server request
-
-	ArgIP      string // IP address and port of this node (e.g. 127.0.0.1:30303)
-	ArgPub     string // public key for asymmetric encryption
-	ArgDBPath  string // path to the server's DB directory
-	ArgIDFile  string // file name with node id (private key)
-	ArgEnode   string // bootstrap node you want to connect to (e.g. enode://e454......08d50@52.176.211.200:16428)
-	ArgTopic   string // topic in hexadecimal format (e.g. 70a4beef)
-	ArgSaveDir string // directory where all incoming messages will be saved as files
+	BootstrapMode  bool `flag:"standalone"`   // boostrap node: don't initiate connection to peers, just wait for incoming connections
+	ForwarderMode  bool `flag:"forwarder"`    // forwarder mode: only forward messages, neither encrypt nor decrypt messages
+	MailServerMode bool `flag:"mailserver"`   // mail server mode: delivers expired messages on demand
+	RequestMail    bool `flag:"mailrequest"`  // request expired messages from the bootstrap server
+	AsymmetricMode bool `flag:"asym"`         // use asymmetric encryption
+	GenerateKey    bool `flag:"generatekey"`  // generate and show the private key
+	FileExMode     bool `flag:"fileexchange"` // file exchange mode
+	FileReader     bool `flag:"filereader"`   // load and decrypt messages saved as files, display as plain text
+	CompactMode    bool `flag:"compact"`      // compact mode: prune the mail server DB by the retention settings, compact it and exit
+	NoDiscovery    bool `flag:"nodiscover"`   // only connect to the bootstrap and static peers, don't look for others
+	TestMode       bool `flag:"test"`         // use of predefined parameters for diagnostics (password, etc.)
+	EchoMode       bool `flag:"echo"`         // echo mode: prints some arguments for diagnostics
+
+	ArgVerbosity  int     `flag:"verbosity"` // log verbosity level
+	ArgTTL        uint    `flag:"ttl"`       // time-to-live for messages in seconds
+	ArgWorkTime   uint    `flag:"work"`      // work time in seconds
+	ArgMaxSize    uint    `flag:"maxsize"`   // max size of message
+	ArgPoW        float64 `flag:"pow"`       // PoW for normal messages in float format (e.g. 2.7)
+	ArgServerPoW  float64 `flag:"mspow"`     // PoW requirement for Mail Server request
+	ArgServerPage uint    `flag:"mspage"`    // maximum number of messages the mail server delivers per page, 0 for no limit
+	ArgBufferSize int     `flag:"buffer"`    // number of received messages buffered for Node.Messages
+	ArgAckTime    uint    `flag:"acktime"`   // time in seconds to wait for file delivery acknowledgements, retransmitting missing pieces; 0 disables them
+
+	// Limits of the files received, so that senders can not exhaust the memory of the node.
+	ArgMaxFile      uint `flag:"maxfile"`      // size in megabytes of the largest file received
+	ArgMaxTransfers uint `flag:"maxtransfers"` // number of chunked files received at the same time
+	ArgTransferMem  uint `flag:"transfermem"`  // megabytes of chunks buffered for the files being received
+
+	// Mail requests are sent once, non-interactively, if any of these is set.
+	ArgMailFrom    uint   `flag:"mailfrom"`    // lower limit of the time range of a mail request (unix timestamp)
+	ArgMailTo      uint   `flag:"mailto"`      // upper limit of the time range of a mail request (unix timestamp), none if 0
+	ArgMailTopic   string `flag:"mailtopic"`   // topics of a mail request, comma separated; all topics if empty
+	ArgMailTimeout uint   `flag:"mailtimeout"` // time in seconds to wait for a page of a mail request
+	ArgMailLimit   uint   `flag:"maillimit"`   // messages per page of a mail request, 0 for as many as the mail server allows
+
+	ArgIP      string `flag:"ip"`      // IP address and port of this node (e.g. 127.0.0.1:30303)
+	ArgPub     string `flag:"pub"`     // public key for asymmetric encryption
+	ArgDBPath  string `flag:"dbpath"`  // path to the server's DB directory, or file for the bolt DB type
+	ArgDBType  string `flag:"dbtype"`  // storage of the mail server: leveldb (default), bolt or memory
+	ArgIDFile  string `flag:"idfile"`  // file name with node id (private key)
+	ArgEnode   string `flag:"boot"`    // bootstrap nodes you want to connect to, comma separated (e.g. enode://e454......08d50@52.176.211.200:16428); the first one is the mail server
+	ArgTopic   string `flag:"topic"`   // topic(s) in hexadecimal format, comma separated (e.g. 70a4beef,70a4bef0); messages are sent with the first one
+	ArgSaveDir string `flag:"savedir"` // directory where all incoming messages will be saved as files
+	ArgRPCAddr string `flag:"rpc"`     // address of the JSON-RPC API over HTTP (e.g. 127.0.0.1:8545), disabled if empty
+	ArgWSAddr  string `flag:"ws"`      // address of the JSON-RPC API over WebSocket (e.g. 127.0.0.1:8546), disabled if empty
+
+	// Network of the node, for running behind NAT, load balancers or in containers.
+	ArgNAT       string `flag:"nat"`       // port mapping: any (default), none, upnp, pmp, pmp:<gateway IP> or extip:<IP>
+	ArgAdvertise string `flag:"advertise"` // IP address, with an optional port, other nodes reach this node at instead of ArgIP (e.g. of a load balancer)
+	ArgMaxPeers  uint   `flag:"maxpeers"`  // maximum number of connected peers; 80, or 800 for a bootstrap node, if 0
+
+	// Publishing of the node's enode and public key, so other nodes need not hardcode them.
+	ArgPublishFile string `flag:"publishfile"` // JSON file the node writes its enode and public key to once started
+	ArgPublishAddr string `flag:"publishaddr"` // address the JSON is served on at /enode (e.g. 127.0.0.1:8548), disabled if empty
+	ArgBootFrom    string `flag:"bootfrom"`    // files or http(s) URLs of published bootstrap nodes, comma separated; added to ArgEnode
+
+	ArgMetricsAddr string `flag:"metrics"`   // address the Prometheus metrics are served on at /metrics (e.g. 127.0.0.1:9100), disabled if empty
+	ArgLogFormat   string `flag:"logformat"` // format of the log written to standard error: terminal (default) or json
+
+	// Encryption of the mail server DB at rest; stored in plain if these are empty.
+	ArgArchivePass    string `flag:"archivepass"`    // passphrase the key of the mail server DB is derived from
+	ArgArchiveKeyFile string `flag:"archivekeyfile"` // file with the key of the mail server DB, 32 bytes in hex
+	ArgMigrateFrom    string `flag:"migratefrom"`    // plain mail server DB to copy into the encrypted one at ArgDBPath, then exit
+
+	// Access control of the mail server; anyone knowing the password may request history if these are empty.
+	ArgMailAllow string `flag:"mailallow"` // file with the public keys allowed to request history and to copy the archive, one hex key per line
+	ArgMailRate  uint   `flag:"mailrate"`  // history requests accepted per minute from one peer, unlimited if 0
+	ArgMailLog   string `flag:"maillog"`   // JSON Lines file every history request is logged to
+
+	// Retention of the mail server DB; nothing is ever removed if all of these are 0.
+	ArgRetainAge   uint `flag:"retainage"`   // time in seconds archived messages are kept
+	ArgRetainSize  uint `flag:"retainsize"`  // size in megabytes the archive is kept under, removing the oldest messages first
+	ArgRetainTopic uint `flag:"retaintopic"` // number of archived messages kept per topic, removing the oldest first
+	ArgPruneTime   uint `flag:"prunetime"`   // time in seconds between two prunings of the archive
+
+	// Replication of the mail server DB between archive nodes. The calls are signed with the key of the node (see
+	// ArgPrivateKeyFile) and pass the ArgMailAllow, ArgMailRate and ArgMailLog of the node called, like mail requests;
+	// serving ArgArchiveAddr requires ArgMailAllow.
+	ArgArchiveAddr  string `flag:"archiveaddr"`  // address other archive nodes copy the DB from over HTTP (e.g. 0.0.0.0:8547), disabled if empty
+	ArgArchiveHosts string `flag:"archivehosts"` // host names the archive nodes call ArgArchiveAddr by, comma separated; IPs and localhost are always accepted
+	ArgSyncPeers    string `flag:"syncpeers"`    // URLs of the ArgArchiveAddr of the archive nodes to copy missing messages from, comma separated
+	ArgSyncTime     uint   `flag:"synctime"`     // time in seconds between two syncs with the archive nodes
+	ArgSyncAge      uint   `flag:"syncage"`      // time in seconds back from now that is compared with the archive nodes
+
+	// Peers kept connected besides the bootstrap nodes, redialed with backoff when the connection is lost.
+	ArgStaticPeers string `flag:"peers"`     // enodes of the static peers, comma separated
+	ArgPeersFile   string `flag:"peersfile"` // file the peers added through the API are kept in across restarts, one enode per line
+
+	// The JSON-RPC and WebSocket APIs can read and send messages and export keys, but authenticate nobody.
+	ArgWSOrigins string `flag:"wsorigins"` // origins accepted by the WebSocket API, comma separated ("*" for any); localhost if empty
+	RPCPublic    bool   `flag:"rpcpublic"` // allow ArgRPCAddr and ArgWSAddr on other than loopback addresses
+
+	ArgBatchDir string `flag:"batchdir"` // directory of saved envelopes to decrypt non-interactively in file reader mode
+	ArgBatchOut string `flag:"batchout"` // JSON Lines file the decrypted batch is written to, standard output if empty
 
 	// My params
-	ArgSymPass string // password for symmetric encryption
-	ArgPrivateKeyFile  string // file name with private key for async encrypting
-	UseSelfPubKey  bool // whether to use self public Key
+	ArgSymPass        string `flag:"sympass"`     // password for symmetric encryption
+	ArgPrivateKeyFile string `flag:"privkeyfile"` // file name with private key for async encrypting
+	UseSelfPubKey     bool   `flag:"selfpub"`     // whether to use self public Key
 }
 
 var DefaultConfig = Config{
-	ArgVerbosity: int(log.LvlError),
-	ArgTTL:       30,
-	ArgWorkTime:  5,
-	ArgMaxSize:   uint(whisperv6.DefaultMaxMessageSize),
-	ArgPoW:       whisperv6.DefaultMinimumPoW,
-	ArgServerPoW: whisperv6.DefaultMinimumPoW,
+	ArgVerbosity:  int(log.LvlError),
+	ArgTTL:        30,
+	ArgWorkTime:   5,
+	ArgMaxSize:    uint(whisperv6.DefaultMaxMessageSize),
+	ArgPoW:        whisperv6.DefaultMinimumPoW,
+	ArgServerPoW:  whisperv6.DefaultMinimumPoW,
+	ArgBufferSize: 256,
+
+	ArgMaxFile:      64,
+	ArgMaxTransfers: 16,
+	ArgTransferMem:  256,
+	ArgServerPage:   1000,
+
+	ArgMailTimeout: 30,
+	ArgPruneTime:   3600,
+	ArgSyncTime:    300,
+	ArgSyncAge:     86400,
 }
 
+// redacted is the value Dump shows instead of a secret.
+const redacted = "********"
+
+// Dump prints the config to standard output in TOML, the format LoadConfig
+// reads. Passwords are replaced by asterisks.
 func Dump(cfg *Config) {
 	var buffer bytes.Buffer
-	e := toml.NewEncoder(&buffer)
-	err := e.Encode(cfg)
-	if err != nil {
-		logger.Get().Fatal(err)
+	if err := toml.NewEncoder(&buffer).Encode(cfg.redacted()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode the config: %s\n", err)
+		return
 	}
-
 	fmt.Println(
 		time.Now().UTC(),
-		"\n---------------------Sevice started with config:\n",
+		"\n---------------------Service started with config:\n",
 		buffer.String(),
 		"\n---------------------")
 }
+
+// redacted returns a copy of c without its secrets.
+func (c *Config) redacted() *Config {
+	r := *c
+	for _, secret := range []*string{&r.ArgSymPass, &r.ArgArchivePass} {
+		if len(*secret) > 0 {
+			*secret = redacted
+		}
+	}
+	return &r
+}
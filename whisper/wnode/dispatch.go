@@ -0,0 +1,241 @@
+package wnode
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+const (
+	// envelopeQueueSize is the number of new envelopes waiting to be matched
+	// against the node's filters. The queue is never allowed to block
+	// whisper; envelopes that do not fit are left to the sweep.
+	envelopeQueueSize = 1024
+
+	// sweepInterval is how often the filters are drained. Envelopes are
+	// normally delivered as soon as whisper adds them to its pool, so the
+	// sweep only picks up what bypasses the pool: peer-to-peer messages from
+	// a mail server and envelopes that did not fit into the queue.
+	sweepInterval = time.Second
+)
+
+// envelopeTap is registered with whisper as its mail server, which is the
+// only hook whisper offers to see every new envelope the moment it enters
+// the pool. It hands envelopes to the node's message loop and forwards both
+// calls to the real mail server, if the node runs one.
+type envelopeTap struct {
+	envelopes chan<- *whisper.Envelope
+	archive   whisper.MailServer
+	metrics   *nodeMetrics
+	log       log.Logger
+}
+
+func (t *envelopeTap) Archive(env *whisper.Envelope) {
+	t.metrics.envelopeAdded(env)
+	if t.archive != nil {
+		t.archive.Archive(env)
+	}
+	if t.envelopes == nil {
+		// a forwarder has no message loop, the tap only counts
+		return
+	}
+	select {
+	case t.envelopes <- env:
+	default:
+		t.log.Debug("envelope queue is full, leaving envelope to the sweep", "hash", env.Hash().Hex())
+	}
+}
+
+func (t *envelopeTap) DeliverMail(peer *whisper.Peer, request *whisper.Envelope) {
+	if t.archive != nil {
+		t.archive.DeliverMail(peer, request)
+	}
+}
+
+// openEnvelope decrypts env with the keys of filter f, if env matches the
+// filter. It performs the same checks whisper does before it triggers a filter,
+// and reports whether env matched but failed to decrypt.
+func openEnvelope(env *whisper.Envelope, f *whisper.Filter) (*whisper.ReceivedMessage, bool) {
+	if !matchTopics(env.Topic, f.Topics) || !f.MatchEnvelope(env) {
+		return nil, false
+	}
+	msg := env.Open(f)
+	if msg == nil {
+		return nil, true
+	}
+	if f.Src != nil && !whisper.IsPubKeyEqual(msg.Src, f.Src) {
+		return nil, false
+	}
+	return msg, false
+}
+
+func matchTopics(topic whisper.TopicType, topics [][]byte) bool {
+	for _, t := range topics {
+		if len(t) >= whisper.TopicLength && bytes.Equal(t[:whisper.TopicLength], topic[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageLoop delivers messages matching the node's subscriptions. New
+// envelopes are pushed by the envelope tap and delivered immediately; the
+// periodic sweep collects the rest from the filters. Every message is
+// delivered once per subscription, whichever way it arrives first.
+func (n *Node) messageLoop() {
+	sweep := time.NewTicker(sweepInterval)
+	defer sweep.Stop()
+	defer close(n.messages)
+
+	type delivery struct {
+		hash         common.Hash
+		subscription string
+	}
+	seen := make(map[delivery]uint32) // => expiry
+	handle := func(msg *whisper.ReceivedMessage, s *subscription) {
+		d := delivery{msg.EnvelopeHash, s.name}
+		if _, ok := seen[d]; ok {
+			return
+		}
+		seen[d] = msg.Sent + msg.TTL
+		if s.history != nil {
+			s.history.receive(msg, s)
+			return
+		}
+		n.handleMessage(msg, s.name)
+	}
+
+	for {
+		select {
+		case env := <-n.envelopes:
+			// subscriptions with different keys may share a topic, so an
+			// envelope only failed if none of them could decrypt it
+			opened, failed := false, false
+			for _, s := range n.subscriptions() {
+				msg, f := openEnvelope(env, s.filter)
+				if msg != nil {
+					handle(msg, s)
+					opened = true
+				}
+				failed = failed || f
+			}
+			if failed && !opened {
+				n.metrics.decryptFailures.Inc()
+			}
+		case <-sweep.C:
+			// a mail server sends the envelopes of a page before its page
+			// marker, so once a marker is retrieved, the envelopes are in
+			// their filters: markers are retrieved first and handled last
+			type retrieved struct {
+				msg *whisper.ReceivedMessage
+				s   *subscription
+			}
+			var markers []retrieved
+			subs := n.subscriptions()
+			for _, s := range subs {
+				if s.marker {
+					for _, msg := range s.filter.Retrieve() {
+						markers = append(markers, retrieved{msg, s})
+					}
+				}
+			}
+			for _, s := range subs {
+				if !s.marker {
+					for _, msg := range s.filter.Retrieve() {
+						handle(msg, s)
+					}
+				}
+			}
+			for _, m := range markers {
+				handle(m.msg, m.s)
+			}
+			now := time.Now()
+			for d, expiry := range seen {
+				if expiry+whisper.DefaultSyncAllowance < uint32(now.Unix()) {
+					delete(seen, d)
+				}
+			}
+			n.expireTransfers(now)
+			n.acknowledgePending()
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *Node) handleMessage(msg *whisper.ReceivedMessage, subscription string) {
+	// files are saved into the save directory, acknowledgements of files
+	// sent go to the waiting sender
+	if n.receiveTransfer(msg, subscription) {
+		return
+	}
+
+	n.log.Debug("message received", "subscription", subscription, "hash", msg.EnvelopeHash.Hex(), "topic", msg.Topic, "size", len(msg.Payload))
+	reportedOnce := false
+	if n.interactive && !n.config.FileExMode && len(msg.Payload) <= 2048 {
+		n.printMessageInfo(msg)
+		reportedOnce = true
+	}
+
+	// All messages are saved upon specifying argSaveDir.
+	// fileExMode only specifies how messages are displayed on the console after they are saved.
+	// if fileExMode == true, only the hashes are displayed, since messages might be too big.
+	if len(n.config.ArgSaveDir) > 0 {
+		n.writeMessageToFile(n.config.ArgSaveDir, msg, subscription, n.interactive && !reportedOnce)
+	}
+	n.deliver(msg, subscription)
+}
+
+// deliver passes the message on to the watchers and to the reader of
+// Messages. The buffer is bounded: while it is full, the oldest buffered
+// message is discarded to make room for the new one, so a slow reader sees
+// the most recent messages and never holds up delivery to the console, the
+// save directory or whisper itself. Dropped reports the number of discarded
+// messages.
+func (n *Node) deliver(msg *whisper.ReceivedMessage, subscription string) {
+	m := newMessage(msg, subscription)
+	n.watchMu.Lock()
+	for _, fn := range n.watchers {
+		fn(m)
+	}
+	n.watchMu.Unlock()
+	for {
+		select {
+		case n.messages <- m:
+			return
+		default:
+		}
+		select {
+		case <-n.messages:
+			atomic.AddUint64(&n.dropped, 1)
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of received messages discarded because the
+// reader of Messages did not keep up.
+func (n *Node) Dropped() uint64 {
+	return atomic.LoadUint64(&n.dropped)
+}
+
+// watch registers fn to be called from the message loop with every message
+// delivered by the node, next to the reader of Messages. fn must not block.
+// The returned function unregisters it.
+func (n *Node) watch(fn func(*Message)) (unwatch func()) {
+	n.watchMu.Lock()
+	defer n.watchMu.Unlock()
+
+	id := n.nextWatcher
+	n.nextWatcher++
+	n.watchers[id] = fn
+	return func() {
+		n.watchMu.Lock()
+		delete(n.watchers, id)
+		n.watchMu.Unlock()
+	}
+}
@@ -0,0 +1,61 @@
+package wnode
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+func TestDeliverDropsOldest(t *testing.T) {
+	c := testConfig()
+	c.ArgBufferSize = 3
+	n := NewNode(c)
+
+	// nobody reads Messages while five messages are delivered
+	for i := byte(1); i <= 5; i++ {
+		n.deliver(&whisper.ReceivedMessage{Payload: []byte{i}}, DefaultSymSubscription)
+		want := uint64(0)
+		if i > 3 {
+			want = uint64(i - 3)
+		}
+		if n.Dropped() != want {
+			t.Errorf("after message %d: %d dropped, want %d", i, n.Dropped(), want)
+		}
+	}
+
+	var got []byte
+	for len(n.Messages()) > 0 {
+		got = append(got, (<-n.Messages()).Payload...)
+	}
+	if want := []byte{3, 4, 5}; !bytes.Equal(got, want) {
+		t.Errorf("buffered %v, want %v: the oldest evicted, the newest kept", got, want)
+	}
+}
+
+func TestPushDelivery(t *testing.T) {
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+
+	// the node's own envelope enters its pool and passes the tap; the sweep
+	// would take up to sweepInterval
+	payload := []byte("pushed")
+	if _, err := n.Send(context.Background(), payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	sent := time.Now()
+	timeout := time.After(sweepInterval / 4)
+	for {
+		select {
+		case msg := <-n.Messages():
+			if bytes.Equal(msg.Payload, payload) {
+				t.Logf("delivered %v after Send", time.Since(sent))
+				return
+			}
+		case <-timeout:
+			t.Fatalf("message not delivered within %v", sweepInterval/4)
+		}
+	}
+}
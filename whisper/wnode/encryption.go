@@ -0,0 +1,277 @@
+package wnode
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	archiveKeyLength  = 32 // AES-256
+	archiveSaltLength = 16
+	archiveIterations = 1 << 16
+	archiveCheck      = "wnode archive"
+)
+
+// archiveMetaKey holds the archiveMeta of an encrypted archive. Archive
+// keys are 36 bytes long, so it never collides with an envelope.
+var archiveMetaKey = []byte("wnode-archive-encryption")
+
+// archiveMeta is stored in plain next to the encrypted envelopes.
+type archiveMeta struct {
+	Salt  []byte // salt of the passphrase
+	Check []byte // archiveCheck sealed with the archive key
+}
+
+// encryptedStore encrypts the values of the underlying store with AES-GCM.
+// The keys, made of the time and hash of the envelopes, stay in plain so
+// the archive can still be iterated in order.
+type encryptedStore struct {
+	Store
+	aead cipher.AEAD
+}
+
+func newEncryptedStore(store Store, key []byte) (*encryptedStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStore{store, aead}, nil
+}
+
+// seal encrypts value, authenticating key along with it so a record can
+// not be moved to another key unnoticed. The nonce is prepended.
+func (s *encryptedStore) seal(key, value []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(value)+s.aead.Overhead())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, value, key), nil
+}
+
+func (s *encryptedStore) open(key, sealed []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("record too short")
+	}
+	return s.aead.Open(nil, sealed[:n], sealed[n:], key)
+}
+
+func (s *encryptedStore) Put(key, value []byte) error {
+	sealed, err := s.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return s.Store.Put(key, sealed)
+}
+
+// Iterate passes the decrypted values to fn. A value that fails to decrypt
+// was tampered with or moved to another key: the iteration stops there and
+// returns the error.
+func (s *encryptedStore) Iterate(start, limit []byte, fn func(key, value []byte) bool) error {
+	var openErr error
+	err := s.Store.Iterate(start, limit, func(key, value []byte) bool {
+		if bytes.Equal(key, archiveMetaKey) {
+			return true
+		}
+		plain, err := s.open(key, value)
+		if err != nil {
+			openErr = fmt.Errorf("archive record %x: %s", key, err)
+			return false
+		}
+		return fn(key, plain)
+	})
+	if err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// lookup returns the value of key in store, or nil if there is none.
+func lookup(store Store, key []byte) ([]byte, error) {
+	var value []byte
+	err := store.Iterate(key, nil, func(k, v []byte) bool {
+		if bytes.Equal(k, key) {
+			value = common.CopyBytes(v)
+		}
+		return false
+	})
+	return value, err
+}
+
+// isEmpty reports whether store holds no records at all.
+func isEmpty(store Store) (bool, error) {
+	empty := true
+	err := store.Iterate(nil, nil, func(k, v []byte) bool {
+		empty = false
+		return false
+	})
+	return empty, err
+}
+
+// encryptsArchive reports whether the mail server DB is encrypted at rest.
+func (c *Config) encryptsArchive() bool {
+	return len(c.ArgArchivePass) > 0 || len(c.ArgArchiveKeyFile) > 0
+}
+
+// archiveCipherKey returns the key of the archive: the content of
+// ArgArchiveKeyFile, or the key derived from ArgArchivePass with salt.
+func (c *Config) archiveCipherKey(salt []byte) ([]byte, error) {
+	if len(c.ArgArchiveKeyFile) > 0 {
+		return loadArchiveKey(c.ArgArchiveKeyFile)
+	}
+	return pbkdf2.Key([]byte(c.ArgArchivePass), salt, archiveIterations, archiveKeyLength, sha256.New), nil
+}
+
+// loadArchiveKey reads a hex encoded archive key from a file.
+func loadArchiveKey(path string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := common.FromHex(strings.TrimSpace(string(raw)))
+	if len(key) != archiveKeyLength {
+		return nil, fmt.Errorf("archive key in %s must be %d bytes in hex", path, archiveKeyLength)
+	}
+	return key, nil
+}
+
+// openArchive opens the mail server store described by c, encrypted if c
+// has an archive passphrase or key file. A new store is set up for
+// encryption when it is first opened with a key. Plain stores with records
+// are not encrypted on the fly: they are converted by MigrateArchive.
+func openArchive(c *Config) (Store, error) {
+	store, err := OpenStore(c.ArgDBType, c.ArgDBPath)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptArchive(store, c)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+func encryptArchive(store Store, c *Config) (Store, error) {
+	raw, err := lookup(store, archiveMetaKey)
+	if err != nil {
+		return nil, err
+	}
+	if !c.encryptsArchive() {
+		if raw != nil {
+			return nil, errors.New("archive is encrypted, ArgArchivePass or ArgArchiveKeyFile is required")
+		}
+		return store, nil
+	}
+
+	var meta archiveMeta
+	if raw != nil {
+		if err := rlp.DecodeBytes(raw, &meta); err != nil {
+			return nil, fmt.Errorf("invalid archive encryption record: %s", err)
+		}
+	} else {
+		empty, err := isEmpty(store)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, errors.New("archive is not encrypted, convert it with ArgMigrateFrom")
+		}
+		meta.Salt = make([]byte, archiveSaltLength)
+		if _, err := crand.Read(meta.Salt); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := c.archiveCipherKey(meta.Salt)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newEncryptedStore(store, key)
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		if check, err := enc.open(archiveMetaKey, meta.Check); err != nil || string(check) != archiveCheck {
+			return nil, errors.New("wrong archive passphrase or key")
+		}
+		return enc, nil
+	}
+	if meta.Check, err = enc.seal(archiveMetaKey, []byte(archiveCheck)); err != nil {
+		return nil, err
+	}
+	if raw, err = rlp.EncodeToBytes(&meta); err != nil {
+		return nil, err
+	}
+	return enc, store.Put(archiveMetaKey, raw)
+}
+
+// MigrateArchive copies the plain mail server store at cfg.ArgMigrateFrom
+// into the encrypted store at cfg.ArgDBPath, both of type cfg.ArgDBType,
+// and returns the number of envelopes copied. The plain store is left as
+// it is; once the copy is complete it can be deleted.
+func MigrateArchive(cfg *Config) (int, error) {
+	if err := cfg.Validate(); err != nil {
+		return 0, err
+	}
+	src, err := OpenStore(cfg.ArgDBType, cfg.ArgMigrateFrom)
+	if err != nil {
+		return 0, &MailServerError{"open", err}
+	}
+	defer src.Close()
+	if meta, err := lookup(src, archiveMetaKey); err != nil || meta != nil {
+		if err == nil {
+			err = errors.New("archive is encrypted already")
+		}
+		return 0, &MailServerError{"migrate", err}
+	}
+
+	dst, err := openArchive(cfg)
+	if err != nil {
+		return 0, &MailServerError{"open", err}
+	}
+	defer dst.Close()
+
+	count := 0
+	var putErr error
+	err = src.Iterate(nil, nil, func(key, value []byte) bool {
+		if putErr = dst.Put(key, value); putErr != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if putErr != nil {
+		err = putErr
+	}
+	if err != nil {
+		return count, &MailServerError{"migrate", err}
+	}
+	return count, nil
+}
+
+// migrateArchive runs MigrateArchive for the console and prints the result.
+func migrateArchive(cfg *Config) error {
+	count, err := MigrateArchive(cfg)
+	if err != nil {
+		return err
+	}
+	newLogger(cfg).Info("mail server database encrypted", "from", cfg.ArgMigrateFrom, "to", cfg.ArgDBPath, "envelopes", count)
+	fmt.Printf("Mail server database encrypted: %d envelopes copied from %s to %s \n", count, cfg.ArgMigrateFrom, cfg.ArgDBPath)
+	return nil
+}
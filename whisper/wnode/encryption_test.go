@@ -0,0 +1,159 @@
+package wnode
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archiveConfig returns the config of an archive of the given kind in dir,
+// encrypted with pass unless it is empty.
+func archiveConfig(dir, kind, pass string) *Config {
+	c := testConfig()
+	c.ArgDBType = kind
+	c.ArgDBPath = filepath.Join(dir, kind)
+	c.ArgArchivePass = pass
+	return c
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, kind := range []string{StoreLevelDB, StoreBolt} {
+		c := archiveConfig(dir, kind, "secret")
+		s, err := openArchive(c)
+		if err != nil {
+			t.Fatalf("%s: failed to open: %v", kind, err)
+		}
+		s.Put([]byte("b"), []byte("second"))
+		s.Put([]byte("a"), []byte("first"))
+		if got := storeContents(t, s, nil, nil); fmt.Sprint(got) != "[a=first b=second]" {
+			t.Errorf("%s: round trip gave %v", kind, got)
+		}
+		s.Close()
+
+		// the values are not stored in plain
+		plain, err := OpenStore(kind, c.ArgDBPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain.Iterate(nil, nil, func(key, value []byte) bool {
+			if bytes.Contains(value, []byte("first")) || bytes.Contains(value, []byte("second")) {
+				t.Errorf("%s: %s stored in plain", kind, key)
+			}
+			return true
+		})
+		plain.Close()
+
+		if s, err = openArchive(c); err != nil {
+			t.Fatalf("%s: failed to reopen: %v", kind, err)
+		}
+		if got := storeContents(t, s, nil, nil); fmt.Sprint(got) != "[a=first b=second]" {
+			t.Errorf("%s: reopened archive holds %v", kind, got)
+		}
+		s.Close()
+
+		if s, err = openArchive(archiveConfig(dir, kind, "wrong")); err == nil {
+			s.Close()
+			t.Errorf("%s: opened with a wrong passphrase", kind)
+		}
+		if s, err = openArchive(archiveConfig(dir, kind, "")); err == nil {
+			s.Close()
+			t.Errorf("%s: opened without a passphrase", kind)
+		}
+	}
+}
+
+func TestEncryptedArchiveMovedRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := archiveConfig(dir, StoreLevelDB, "secret")
+	s, err := openArchive(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put([]byte("a"), []byte("first"))
+	s.Close()
+
+	// a record copied to another key fails to decrypt and is rejected
+	plain, err := OpenStore(c.ArgDBType, c.ArgDBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := lookup(plain, []byte("a"))
+	plain.Put([]byte("z"), sealed)
+	plain.Close()
+
+	if s, err = openArchive(c); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if value, err := lookup(s, []byte("z")); err == nil {
+		t.Errorf("moved record accepted as %q", value)
+	}
+	var keys []string
+	err = s.Iterate(nil, nil, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if err == nil || fmt.Sprint(keys) != "[a]" {
+		t.Errorf("iteration passed %v, error %v; want [a] and an error", keys, err)
+	}
+}
+
+func TestMigrateArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "plain")
+	plain, err := OpenStore(StoreBolt, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		plain.Put([]byte(key), []byte("v"+key))
+	}
+	plain.Close()
+
+	c := archiveConfig(dir, StoreBolt, "secret")
+	c.ArgMigrateFrom = src
+	count, err := MigrateArchive(c)
+	if err != nil || count != 3 {
+		t.Fatalf("migrated %d envelopes: %v", count, err)
+	}
+	s, err := openArchive(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := storeContents(t, s, nil, nil); fmt.Sprint(got) != "[a=va b=vb c=vc]" {
+		t.Errorf("migrated archive holds %v", got)
+	}
+	s.Close()
+
+	// the encrypted archive is not migrated again, nor opened as a source
+	c.ArgMigrateFrom, c.ArgDBPath = c.ArgDBPath, filepath.Join(dir, "again")
+	if _, err := MigrateArchive(c); err == nil {
+		t.Error("encrypted archive migrated")
+	}
+	// a plain archive with records is not encrypted on the fly
+	c = archiveConfig(dir, StoreBolt, "secret")
+	c.ArgDBPath = src
+	if s, err := openArchive(c); err == nil {
+		s.Close()
+		t.Error("plain archive with records opened as an encrypted one")
+	}
+}
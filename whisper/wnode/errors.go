@@ -0,0 +1,76 @@
+package wnode
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConnectTimeout is returned by Start when a non-bootstrap node could not
+// connect to any peer in time.
+var ErrConnectTimeout = errors.New("timeout expired, failed to connect")
+
+// ErrNotStarted is returned by the methods of a Node that need the node to
+// be running, when Start did not succeed.
+var ErrNotStarted = errors.New("node is not started")
+
+// ErrNotAcknowledged is returned by SendFile when the receiver did not
+// acknowledge the file within Config.ArgAckTime.
+var ErrNotAcknowledged = errors.New("file was not acknowledged in time")
+
+// ConfigError reports an invalid or missing configuration value.
+type ConfigError struct {
+	Field string // name of the Config field, e.g. "ArgTopic"
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config %s: %v", e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// KeyError reports a failure to load, generate or install a key.
+type KeyError struct {
+	Key string // which key failed, e.g. "node id" or "symmetric key"
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+func (e *KeyError) Unwrap() error { return e.Err }
+
+// NetworkError reports a failure of the p2p server or the whisper protocol.
+type NetworkError struct {
+	Op  string // operation that failed, e.g. "start server" or "send"
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+// MailServerError reports a failure of the mail server or of a request for
+// expired messages sent to it.
+type MailServerError struct {
+	Op  string // operation that failed, e.g. "init" or "request"
+	Err error
+}
+
+func (e *MailServerError) Error() string {
+	return fmt.Sprintf("mail server %s: %v", e.Op, e.Err)
+}
+
+func (e *MailServerError) Unwrap() error { return e.Err }
+
+// RefusedError reports a history request refused by the mail server.
+type RefusedError struct {
+	Reason string // e.g. "requester is not allowed"
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("refused by the mail server: %s", e.Reason)
+}
@@ -0,0 +1,320 @@
+package wnode
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// HistoryQuery selects archived messages to request from a mail server.
+type HistoryQuery struct {
+	From   uint32              // unix time
+	To     uint32              // unix time, inclusive; no upper limit if 0
+	Topics []whisper.TopicType // all topics if empty
+	Limit  uint32              // messages per page, 0 for as many as the mail server allows
+	Cursor []byte              // where the page starts, From if empty
+}
+
+// HistoryPage holds the messages delivered for a HistoryQuery.
+type HistoryPage struct {
+	Messages []*Message
+	Cursor   []byte // where the next page starts, nil after the last page
+}
+
+// historyRequest collects the messages and page markers delivered for a
+// history request.
+type historyRequest struct {
+	from, to uint32
+	log      log.Logger
+
+	mu       sync.Mutex
+	messages []*Message
+	seen     map[common.Hash]bool
+	pages    chan *mailPage
+}
+
+func newHistoryRequest(from, to uint32, logger log.Logger) *historyRequest {
+	return &historyRequest{
+		from:  from,
+		to:    to,
+		log:   logger,
+		seen:  make(map[common.Hash]bool),
+		pages: make(chan *mailPage, 16),
+	}
+}
+
+// receive takes a message delivered to one of the request's filters.
+func (r *historyRequest) receive(msg *whisper.ReceivedMessage, s *subscription) {
+	if s.marker {
+		page, err := decodeMailPage(msg.Payload)
+		if err != nil {
+			r.log.Warn("invalid page marker", "hash", msg.EnvelopeHash.Hex(), "err", err)
+			return
+		}
+		select {
+		case r.pages <- page:
+		default:
+			r.log.Warn("page marker dropped, nobody waits for it", "request", page.Request.Hex())
+		}
+		return
+	}
+	r.add(newMessage(msg, s.origin))
+}
+
+// add records msg if it was sent in the requested time range.
+func (r *historyRequest) add(msg *Message) {
+	sent := uint32(msg.Sent.Unix())
+	if sent < r.from || r.to != 0 && sent > r.to {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen[msg.Hash] {
+		return
+	}
+	r.seen[msg.Hash] = true
+	r.messages = append(r.messages, msg)
+}
+
+func (r *historyRequest) result() []*Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Message(nil), r.messages...)
+}
+
+// wait returns the page marker of the request sent in envelope hash.
+func (r *historyRequest) wait(ctx context.Context, hash common.Hash) (*mailPage, error) {
+	for {
+		select {
+		case page := <-r.pages:
+			if page.Request == hash {
+				return page, nil
+			}
+		case <-ctx.Done():
+			return nil, &MailServerError{"request", ctx.Err()}
+		}
+	}
+}
+
+// RequestHistory asks the mail server peer (an enode URL) for all messages
+// archived between from and to (0 meaning no upper limit) on the given
+// topics, or on all topics if there are none. The messages are fetched in
+// pages of Config.ArgMailLimit messages. The request is encrypted with the
+// key derived from the node's mail server password. Messages are opened
+// with the keys of the node's subscriptions.
+//
+// RequestHistory returns the messages once the mail server has sent the
+// last page. If ctx is done first, it returns the messages received so far
+// along with a MailServerError holding ctx.Err().
+func (n *Node) RequestHistory(ctx context.Context, peer string, from, to uint32, topics []whisper.TopicType) ([]*Message, error) {
+	q := HistoryQuery{From: from, To: to, Topics: topics, Limit: uint32(n.config.ArgMailLimit)}
+	page, err := n.requestHistory(ctx, peer, n.msPassword, q, true)
+	if page == nil {
+		return nil, err
+	}
+	return page.Messages, err
+}
+
+// RequestHistoryPage asks the mail server peer for a single page of the
+// messages selected by q. Large histories are fetched incrementally by
+// passing the Cursor of each page on in the query for the next one, until
+// it is nil.
+//
+// If ctx is done before the page is complete, RequestHistoryPage returns
+// the messages received so far and q.Cursor, along with a MailServerError
+// holding ctx.Err().
+func (n *Node) RequestHistoryPage(ctx context.Context, peer string, q HistoryQuery) (*HistoryPage, error) {
+	return n.requestHistory(ctx, peer, n.msPassword, q, false)
+}
+
+// requestHistory requests the page of q, or all pages from q on.
+func (n *Node) requestHistory(ctx context.Context, peer, password string, q HistoryQuery, all bool) (*HistoryPage, error) {
+	if !n.running() {
+		return nil, ErrNotStarted
+	}
+	if len(peer) == 0 {
+		return nil, &ConfigError{"peer", errors.New("mail server enode is required")}
+	}
+	peerID, err := extractIDFromEnode(normalizeEnode(peer))
+	if err != nil {
+		return nil, &ConfigError{"peer", err}
+	}
+	if len(password) == 0 {
+		return nil, &ConfigError{"ArgSymPass", errors.New("mail server password is required")}
+	}
+	if len(q.Cursor) > 0 && len(q.Cursor) != archiveKeySize {
+		return nil, &ConfigError{"Cursor", fmt.Errorf("cursor has %d bytes instead of %d", len(q.Cursor), archiveKeySize)}
+	}
+	key, err := mailServerKey(n.shh, password)
+	if err != nil {
+		return nil, &KeyError{"mail server key", err}
+	}
+
+	r := newHistoryRequest(q.From, q.To, n.log.New("mailserver", fmt.Sprintf("%x", peerID[:8])))
+	if err := n.installHistory(r, key, q.Topics); err != nil {
+		return nil, err
+	}
+	defer n.uninstallHistory(r)
+
+	for {
+		hash, err := n.requestMail(peerID, key, q)
+		if err != nil {
+			return nil, err
+		}
+		page, err := r.wait(ctx, hash)
+		if err != nil {
+			return &HistoryPage{Messages: r.result(), Cursor: q.Cursor}, err
+		}
+		if len(page.Error) > 0 {
+			r.log.Warn("mail request refused", "reason", page.Error)
+			return &HistoryPage{Messages: r.result(), Cursor: q.Cursor}, &MailServerError{"request", &RefusedError{page.Error}}
+		}
+		r.log.Debug("history page received", "messages", page.Count, "last", len(page.Cursor) == 0)
+		q.Cursor = nil
+		if len(page.Cursor) > 0 {
+			q.Cursor = page.Cursor
+		}
+		if !all || q.Cursor == nil {
+			return &HistoryPage{Messages: r.result(), Cursor: q.Cursor}, nil
+		}
+	}
+}
+
+// installHistory installs a filter accepting peer-to-peer messages for
+// every key of the node's subscriptions, and one for the page markers of
+// the mail server with key. The messages these filters receive go to r
+// only.
+func (n *Node) installHistory(r *historyRequest, key []byte, topics []whisper.TopicType) error {
+	n.subsMu.Lock()
+	defer n.subsMu.Unlock()
+
+	marker := &subscription{
+		name:    fmt.Sprintf("history-%p", r),
+		history: r,
+		marker:  true,
+	}
+	err := n.install(marker, &whisper.Filter{
+		KeySym:   key,
+		Topics:   [][]byte{mailPageTopic[:]},
+		AllowP2P: true,
+	})
+	if err != nil {
+		return err
+	}
+	installed := []*subscription{marker}
+	for name, s := range n.subs {
+		if s.history != nil {
+			continue
+		}
+		filter := &whisper.Filter{
+			KeySym:   s.filter.KeySym,
+			KeyAsym:  s.filter.KeyAsym,
+			Topics:   s.filter.Topics,
+			AllowP2P: true,
+			PoW:      s.filter.PoW,
+		}
+		if len(topics) > 0 {
+			filter.Topics = topicsToBytes(topics)
+		}
+		h := &subscription{
+			name:    fmt.Sprintf("history-%p-%s", r, name),
+			origin:  name,
+			history: r,
+		}
+		if err := n.install(h, filter); err != nil {
+			n.uninstall(installed)
+			return err
+		}
+		installed = append(installed, h)
+	}
+	return nil
+}
+
+func (n *Node) uninstallHistory(r *historyRequest) {
+	n.subsMu.Lock()
+	defer n.subsMu.Unlock()
+
+	var installed []*subscription
+	for _, s := range n.subs {
+		if s.history == r {
+			installed = append(installed, s)
+		}
+	}
+	n.uninstall(installed)
+}
+
+// uninstall removes the given subscriptions. It must be called with subsMu
+// held.
+func (n *Node) uninstall(subs []*subscription) {
+	for _, s := range subs {
+		delete(n.subs, s.name)
+		n.shh.Unsubscribe(s.filterID)
+	}
+}
+
+// requestMail asks the mail server peerID for the page of q and returns the
+// hash of the request envelope, which the page marker refers to. The
+// request is encrypted with key. The mail server sends the envelopes back
+// as peer-to-peer messages, which reach the subscriptions that allow them.
+func (n *Node) requestMail(peerID []byte, key []byte, q HistoryQuery) (common.Hash, error) {
+	n.shh.AllowP2PMessagesFromPeer(peerID)
+
+	var bloom []byte
+	if len(q.Topics) > 0 {
+		bloom = make([]byte, whisper.BloomFilterSize)
+		for _, t := range q.Topics {
+			for i, b := range whisper.TopicToBloom(t) {
+				bloom[i] |= b
+			}
+		}
+		n.obfuscateBloom(bloom)
+	} else {
+		bloom = whisper.MakeFullNodeBloom()
+	}
+
+	to := q.To
+	if to == 0 {
+		to = 0xFFFFFFFF
+	}
+
+	data := make([]byte, requestHeaderSize, requestHeaderSize+whisper.BloomFilterSize+4+len(q.Cursor))
+	binary.BigEndian.PutUint32(data, q.From)
+	binary.BigEndian.PutUint32(data[4:], to)
+	data = append(data, bloom...)
+	var limit [4]byte
+	binary.BigEndian.PutUint32(limit[:], q.Limit)
+	data = append(data, limit[:]...)
+	data = append(data, q.Cursor...)
+
+	var params whisper.MessageParams
+	params.PoW = n.config.ArgServerPoW
+	params.Payload = data
+	params.KeySym = key
+	params.Src = n.asymKey
+	params.WorkTime = 5
+
+	msg, err := whisper.NewSentMessage(&params)
+	if err != nil {
+		return common.Hash{}, &MailServerError{"request", fmt.Errorf("failed to create new message: %s", err)}
+	}
+	start := time.Now()
+	env, err := msg.Wrap(&params)
+	n.metrics.observePoW(start)
+	if err != nil {
+		return common.Hash{}, &MailServerError{"request", fmt.Errorf("wrap failed: %s", err)}
+	}
+
+	err = n.shh.RequestHistoricMessages(peerID, env)
+	if err != nil {
+		return common.Hash{}, &MailServerError{"request", fmt.Errorf("failed to send P2P message: %s", err)}
+	}
+	return env.Hash(), nil
+}
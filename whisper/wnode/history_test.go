@@ -0,0 +1,96 @@
+package wnode
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// startMailServer starts a mail server with an archive in memory and a
+// plain node connected to it, fetching pages of limit messages. The mail
+// server archives count envelopes for the plain node and returns their
+// payloads.
+func startMailServer(t *testing.T, limit uint, count int) (*Node, *Node, map[string]bool) {
+	boot := testConfig()
+	boot.MailServerMode = true
+	boot.ArgDBType = StoreMemory
+	plain := testConfig()
+	plain.ArgMailLimit = limit
+	b, p := startTestNodes(t, boot, plain)
+
+	payloads := make(map[string]bool)
+	for i := 0; i < count; i++ {
+		payload := fmt.Sprintf("archived %d", i)
+		b.mailServer.Archive(sealTestEnvelope(t, []byte(payload), nil, b.SymKey(), nil))
+		payloads[payload] = true
+	}
+	return b, p, payloads
+}
+
+func TestRequestHistory(t *testing.T) {
+	b, p, payloads := startMailServer(t, 3, 7)
+	defer b.Stop()
+	defer p.Stop()
+
+	// the page markers end the request, long before the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	msgs, err := p.RequestHistory(ctx, b.Enode(), 0, 0, nil)
+	if err != nil {
+		t.Fatalf("request failed after %v: %v", time.Since(start), err)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Errorf("request took %v", elapsed)
+	}
+	got := make(map[string]int)
+	for _, m := range msgs {
+		got[string(m.Payload)]++
+	}
+	for payload := range payloads {
+		if got[payload] != 1 {
+			t.Errorf("%q received %d times", payload, got[payload])
+		}
+	}
+	if len(msgs) != len(payloads) {
+		t.Errorf("received %d messages, want %d", len(msgs), len(payloads))
+	}
+}
+
+func TestRequestHistoryPages(t *testing.T) {
+	b, p, payloads := startMailServer(t, 3, 7)
+	defer b.Stop()
+	defer p.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	got := make(map[string]int)
+	var sizes []int
+	q := HistoryQuery{Limit: 3}
+	for {
+		page, err := p.RequestHistoryPage(ctx, b.Enode(), q)
+		if err != nil {
+			t.Fatalf("page %d: %v", len(sizes)+1, err)
+		}
+		sizes = append(sizes, len(page.Messages))
+		for _, m := range page.Messages {
+			got[string(m.Payload)]++
+		}
+		if page.Cursor == nil {
+			break
+		}
+		if len(sizes) == 5 {
+			t.Fatalf("cursor %x does not advance", page.Cursor)
+		}
+		q.Cursor = page.Cursor
+	}
+	if fmt.Sprint(sizes) != "[3 3 1]" {
+		t.Errorf("pages of %v messages, want [3 3 1]", sizes)
+	}
+	for payload := range payloads {
+		if got[payload] != 1 {
+			t.Errorf("%q received %d times", payload, got[payload])
+		}
+	}
+}
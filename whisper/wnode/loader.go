@@ -0,0 +1,193 @@
+package wnode
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix is prepended to the upper-cased flag name of every Config field
+// to get the name of its environment variable, e.g. WNODE_TOPIC.
+const envPrefix = "WNODE_"
+
+// Source tells where the value of a Config field came from.
+type Source string
+
+const (
+	SourceDefault Source = "default" // value the config had before loading
+	SourceFile    Source = "file"    // TOML config file
+	SourceEnv     Source = "env"     // WNODE_* environment variable
+	SourceFlag    Source = "flag"    // command-line flag
+)
+
+// Sources maps Config field names to the source of their value.
+type Sources map[string]Source
+
+func (s Sources) String() string {
+	fields := make([]string, 0, len(s))
+	for f := range s {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	var b strings.Builder
+	for _, f := range fields {
+		fmt.Fprintf(&b, "%s = %s\n", f, s[f])
+	}
+	return b.String()
+}
+
+// LoadConfig overlays cfg with a TOML file, WNODE_* environment variables
+// and the command-line args, in that order, so that flags take precedence
+// over the environment and the environment over the file. The file is
+// named by the -config flag or the WNODE_CONFIG variable; its keys are the
+// Config field names, as written by Dump; a key that names no field is
+// rejected, so that a typo does not go unnoticed. Fields not set by any
+// source keep the value cfg had before. LoadConfig reports where every
+// field's value came from. If any source fails, cfg is left as it was.
+func LoadConfig(cfg *Config, args []string) (Sources, error) {
+	var flagged Config
+	fs := flag.NewFlagSet("wnode", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "TOML config file (env "+envPrefix+"CONFIG)")
+	defineFlags(fs, &flagged)
+	if err := fs.Parse(args); err != nil {
+		return nil, &ConfigError{"flags", err}
+	}
+
+	loaded := *cfg
+	sources := make(Sources)
+	v := reflect.ValueOf(&loaded).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sources[t.Field(i).Name] = SourceDefault
+	}
+
+	if len(*path) > 0 {
+		md, err := toml.DecodeFile(*path, &loaded)
+		if err != nil {
+			return nil, &ConfigError{"config", err}
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return nil, &ConfigError{"config", fmt.Errorf("%s: unknown keys %s", *path, strings.Join(keys, ", "))}
+		}
+		for _, key := range md.Keys() {
+			if f, ok := fieldByKey(t, key[len(key)-1]); ok {
+				sources[f.Name] = SourceFile
+			}
+		}
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("flag")
+		if name == "" {
+			continue
+		}
+		s, ok := os.LookupEnv(envName(name))
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), s); err != nil {
+			return nil, &ConfigError{f.Name, fmt.Errorf("%s: %v", envName(name), err)}
+		}
+		sources[f.Name] = SourceEnv
+	}
+
+	fv := reflect.ValueOf(&flagged).Elem()
+	fs.Visit(func(fl *flag.Flag) {
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).Tag.Get("flag") == fl.Name {
+				v.Field(i).Set(fv.Field(i))
+				sources[t.Field(i).Name] = SourceFlag
+			}
+		}
+	})
+	*cfg = loaded
+	return sources, nil
+}
+
+// defineFlags defines a flag for every tagged Config field, storing the
+// parsed values in cfg.
+func defineFlags(fs *flag.FlagSet, cfg *Config) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("flag")
+		if name == "" {
+			continue
+		}
+		usage := fmt.Sprintf("sets %s (env %s)", f.Name, envName(name))
+		switch p := v.Field(i).Addr().Interface().(type) {
+		case *bool:
+			fs.BoolVar(p, name, false, usage)
+		case *int:
+			fs.IntVar(p, name, 0, usage)
+		case *uint:
+			fs.UintVar(p, name, 0, usage)
+		case *float64:
+			fs.Float64Var(p, name, 0, usage)
+		case *string:
+			fs.StringVar(p, name, "", usage)
+		}
+	}
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(flagName)
+}
+
+// fieldByKey finds the field a TOML key is decoded into. Keys are matched
+// case-insensitively, as the TOML decoder does.
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(t.Field(i).Name, key) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func setField(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		x, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(x)
+	case reflect.Int:
+		x, err := strconv.ParseInt(s, 10, 0)
+		if err != nil {
+			return err
+		}
+		v.SetInt(x)
+	case reflect.Uint:
+		x, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			return err
+		}
+		v.SetUint(x)
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(x)
+	case reflect.String:
+		v.SetString(s)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
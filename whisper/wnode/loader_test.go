@@ -0,0 +1,99 @@
+package wnode
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "wnode-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "wnode.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "ArgTopic = \"66696c65\"\nArgTTL = 60\nArgPoW = 0.5\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// the topic is set by all three sources, the TTL by the file and the
+	// environment, the PoW by the file only
+	os.Setenv(envPrefix+"TOPIC", "656e7600")
+	os.Setenv(envPrefix+"TTL", "90")
+	defer os.Unsetenv(envPrefix + "TOPIC")
+	defer os.Unsetenv(envPrefix + "TTL")
+
+	cfg := DefaultConfig
+	sources, err := LoadConfig(&cfg, []string{"-config", path, "-topic", "666c6167"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ArgTopic != "666c6167" || sources["ArgTopic"] != SourceFlag {
+		t.Errorf("topic: got %q from %s, want the flag", cfg.ArgTopic, sources["ArgTopic"])
+	}
+	if cfg.ArgTTL != 90 || sources["ArgTTL"] != SourceEnv {
+		t.Errorf("ttl: got %d from %s, want 90 from the environment", cfg.ArgTTL, sources["ArgTTL"])
+	}
+	if cfg.ArgPoW != 0.5 || sources["ArgPoW"] != SourceFile {
+		t.Errorf("pow: got %v from %s, want 0.5 from the file", cfg.ArgPoW, sources["ArgPoW"])
+	}
+	if cfg.ArgWorkTime != DefaultConfig.ArgWorkTime || sources["ArgWorkTime"] != SourceDefault {
+		t.Errorf("work time: got %d from %s, want the default", cfg.ArgWorkTime, sources["ArgWorkTime"])
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	path := writeConfigFile(t, "ArgSymPass = \"secret\"\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	os.Setenv(envPrefix+"CONFIG", path)
+	defer os.Unsetenv(envPrefix + "CONFIG")
+
+	cfg := DefaultConfig
+	sources, err := LoadConfig(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ArgSymPass != "secret" || sources["ArgSymPass"] != SourceFile {
+		t.Errorf("password: got %q from %s, want the file named by %sCONFIG", cfg.ArgSymPass, sources["ArgSymPass"], envPrefix)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := writeConfigFile(t, "ArgTopic = \"74657374\"\nArgTopik = \"74657374\"\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg := DefaultConfig
+	_, err := LoadConfig(&cfg, []string{"-config", path})
+	var cfgErr *ConfigError
+	if !errors.As(err, &cfgErr) || cfgErr.Field != "config" {
+		t.Fatalf("got %v, want a ConfigError for the unknown key", err)
+	}
+}
+
+func TestLoadConfigBadEnv(t *testing.T) {
+	path := writeConfigFile(t, "ArgTopic = \"66696c65\"\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	os.Setenv(envPrefix+"TTL", "forever")
+	defer os.Unsetenv(envPrefix + "TTL")
+
+	cfg := DefaultConfig
+	_, err := LoadConfig(&cfg, []string{"-config", path})
+	var cfgErr *ConfigError
+	if !errors.As(err, &cfgErr) || cfgErr.Field != "ArgTTL" {
+		t.Fatalf("got %v, want a ConfigError for ArgTTL", err)
+	}
+	// the file was read before the environment failed
+	if !reflect.DeepEqual(cfg, DefaultConfig) {
+		t.Errorf("config changed by a failed load: topic %q", cfg.ArgTopic)
+	}
+}
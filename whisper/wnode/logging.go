@@ -0,0 +1,53 @@
+package wnode
+
+import (
+	"os"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// Formats of the log, selected by Config.ArgLogFormat. Events are logged
+// with the geth logger, the console of an interactive node only shows what
+// its user needs to see.
+const (
+	LogTerminal = "terminal" // human readable lines, the default
+	LogJSON     = "json"     // one JSON object per line, for log pipelines
+)
+
+// newLogger returns a logger that writes the records up to c.ArgVerbosity
+// to standard error in c.ArgLogFormat. Every node has a logger of its own,
+// so nodes of one process log at their own verbosity; the root logger is
+// left to the application.
+func newLogger(c *Config) log.Logger {
+	format := log.TerminalFormat(false)
+	if c.ArgLogFormat == LogJSON {
+		format = log.JSONFormat()
+	}
+	l := log.New()
+	l.SetHandler(log.LvlFilterHandler(log.Lvl(c.ArgVerbosity), log.StreamHandler(os.Stderr, format)))
+	return l
+}
+
+// logPeers logs the peers connecting to and disconnecting from the node,
+// until the node stops.
+func (n *Node) logPeers() {
+	events := make(chan *p2p.PeerEvent, 16)
+	sub := n.server.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+	for {
+		select {
+		case ev := <-events:
+			switch ev.Type {
+			case p2p.PeerEventTypeAdd:
+				n.log.Info("peer connected", "peer", ev.Peer.TerminalString())
+			case p2p.PeerEventTypeDrop:
+				n.log.Info("peer disconnected", "peer", ev.Peer.TerminalString(), "err", ev.Error)
+			}
+		case <-sub.Err():
+			return
+		case <-n.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package wnode
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+func TestNodeLoggers(t *testing.T) {
+	// whisper and the p2p server log to the root logger too, the records
+	// of the nodes carry the node field
+	var mu sync.Mutex
+	leaked := 0
+	root := log.Root().GetHandler()
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		for i := 0; i < len(r.Ctx); i += 2 {
+			if r.Ctx[i] == "node" {
+				mu.Lock()
+				leaked++
+				mu.Unlock()
+			}
+		}
+		return nil
+	}))
+	defer log.Root().SetHandler(root)
+
+	b, p := startTestNodes(t, testConfig(), testConfig())
+	p.Stop()
+	b.Stop()
+	log.Info("probe", "node", "test")
+
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case leaked == 0:
+		t.Error("root log handler replaced")
+	case leaked > 1:
+		t.Errorf("%d records of the nodes logged to the root logger", leaked-1)
+	}
+}
+
+func TestDumpRedacted(t *testing.T) {
+	c := testConfig()
+	c.ArgSymPass = "symmetric secret"
+	c.ArgArchivePass = "archive secret"
+	var dump strings.Builder
+	if err := toml.NewEncoder(&dump).Encode(c.redacted()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dump.String(), "secret") {
+		t.Errorf("secrets dumped:\n%s", dump.String())
+	}
+	if c.ArgSymPass != "symmetric secret" {
+		t.Error("config changed by redacting it")
+	}
+}
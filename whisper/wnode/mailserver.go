@@ -0,0 +1,346 @@
+package wnode
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// A mail request is the payload of an envelope encrypted with the key
+// derived from the mail server password:
+//
+//	from (4 bytes) | to (4 bytes) [| bloom (64 bytes) [| limit (4 bytes) [| cursor]]]
+//
+// Requests without a limit are served the way mailserver.WMailServer serves
+// them: all matching envelopes at once and nothing else. Requests with a
+// limit are served in pages of at most limit envelopes (0 meaning as many
+// as the server allows), each followed by a page marker. The marker holds
+// the cursor the next page starts at, which is empty after the last page,
+// or the reason the request was refused.
+const (
+	mailPageMagic = "wnmp"
+
+	requestHeaderSize = 8
+	archiveKeySize    = 4 + common.HashLength
+)
+
+// mailPageTopic is the topic of page markers.
+var mailPageTopic = whisper.BytesToTopic([]byte(mailPageMagic))
+
+// mailRequest is a decoded mail request.
+type mailRequest struct {
+	from, to uint32
+	bloom    []byte
+	paged    bool   // the requester expects pages and page markers
+	limit    uint32 // envelopes per page, 0 for no limit
+	cursor   []byte // archive key the page starts at, from if empty
+	src      *ecdsa.PublicKey
+}
+
+// mailPage is the page marker sent after the envelopes of a page.
+type mailPage struct {
+	Request common.Hash // hash of the request envelope
+	Count   uint32      // envelopes delivered in the page
+	Cursor  []byte      // start of the next page, empty after the last one
+	Error   string      // why the request was refused, if it was
+}
+
+// mailServer archives envelopes and delivers them to peers on request. Its
+// LevelDB store keeps the database layout of mailserver.WMailServer, so
+// existing databases can be used as they are.
+type mailServer struct {
+	shh       *whisper.Whisper
+	pow       float64
+	key       []byte
+	limit     uint32 // maximum envelopes per page, 0 for no limit
+	retention retention
+	access    *mailAccess
+	metrics   *nodeMetrics
+	log       log.Logger
+
+	mu    sync.RWMutex // held for writing only to close the store
+	store Store
+}
+
+// Init opens the store of c.ArgDBType at c.ArgDBPath, encrypted if c says
+// so, and takes the PoW requirement, page limit, retention and access
+// control from c.
+func (s *mailServer) Init(shh *whisper.Whisper, password string, c *Config) error {
+	if len(c.ArgDBPath) == 0 && c.ArgDBType != StoreMemory {
+		return errors.New("DB file is not specified")
+	}
+	if len(password) == 0 {
+		return errors.New("password is not specified")
+	}
+
+	store, err := openArchive(c)
+	if err != nil {
+		return fmt.Errorf("open DB file: %s", err)
+	}
+	key, err := mailServerKey(shh, password)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	access, err := newMailAccess(c, s.log)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	s.store, s.shh, s.key, s.access = store, shh, key, access
+	s.pow, s.limit, s.retention = c.ArgServerPoW, uint32(c.ArgServerPage), c.retention()
+	return nil
+}
+
+func (s *mailServer) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store != nil {
+		s.store.Close()
+		s.access.close()
+		s.store = nil
+	}
+}
+
+// mailServerKey derives the symmetric key of mail requests from password.
+func mailServerKey(shh *whisper.Whisper, password string) ([]byte, error) {
+	id, err := shh.AddSymKeyFromPassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("create symmetric key: %s", err)
+	}
+	defer shh.DeleteSymKey(id)
+	key, err := shh.GetSymKey(id)
+	if err != nil {
+		return nil, fmt.Errorf("save symmetric key: %s", err)
+	}
+	return key, nil
+}
+
+// archiveKey returns the database key of an envelope sent at t: the time
+// followed by the hash, so the database is ordered by time.
+func archiveKey(t uint32, hash common.Hash) []byte {
+	key := make([]byte, archiveKeySize)
+	binary.BigEndian.PutUint32(key, t)
+	copy(key[4:], hash[:])
+	return key
+}
+
+func (s *mailServer) Archive(env *whisper.Envelope) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.store == nil {
+		return
+	}
+
+	raw, err := rlp.EncodeToBytes(env)
+	if err != nil {
+		s.log.Error("failed to encode envelope for the archive", "hash", env.Hash().Hex(), "err", err)
+		return
+	}
+	if err := s.store.Put(archiveKey(env.Expiry-env.TTL, env.Hash()), raw); err != nil {
+		s.log.Error("failed to archive envelope", "hash", env.Hash().Hex(), "err", err)
+	}
+}
+
+func (s *mailServer) DeliverMail(peer *whisper.Peer, request *whisper.Envelope) {
+	if peer == nil {
+		s.log.Error("whisper peer is nil")
+		return
+	}
+	id := fmt.Sprintf("%x", peer.ID())
+	req, err := s.openRequest(request)
+	if err != nil {
+		s.log.Warn("invalid mail request", "peer", id, "err", err)
+		s.metrics.mailRequest(mailInvalid, 0)
+		return
+	}
+
+	rec := &MailRequestRecord{
+		Time:      time.Now(),
+		Peer:      id,
+		Requester: crypto.FromECDSAPub(req.src),
+		From:      req.from,
+		To:        req.to,
+		Limit:     req.limit,
+		Cursor:    req.cursor,
+	}
+	defer s.access.record(rec)
+	page := &mailPage{Request: request.Hash()}
+	if err := s.access.authorize(id, req.src, rec.Time); err != nil {
+		rec.Refused, page.Error = err.Error(), err.Error()
+		s.metrics.mailRequest(mailRefused, 0)
+	} else {
+		send := func(env *whisper.Envelope) error { return s.shh.SendP2PDirect(peer, env) }
+		page.Count, page.Cursor, err = s.deliver(send, req)
+		rec.Delivered = page.Count
+		if err != nil {
+			s.log.Error("failed to deliver mail", "peer", id, "err", err)
+			s.metrics.mailRequest(mailFailed, rec.Delivered)
+			return
+		}
+		s.metrics.mailRequest(mailServed, rec.Delivered)
+	}
+	if req.paged {
+		if err := s.sendPage(peer, page); err != nil {
+			s.log.Error("failed to send page marker", "peer", id, "err", err)
+		}
+	}
+}
+
+// openRequest decrypts and decodes a mail request.
+func (s *mailServer) openRequest(request *whisper.Envelope) (*mailRequest, error) {
+	if s.pow > 0.0 && request.PoW() < s.pow {
+		return nil, fmt.Errorf("PoW %f is below %f", request.PoW(), s.pow)
+	}
+	msg := request.Open(&whisper.Filter{KeySym: s.key})
+	if msg == nil {
+		return nil, errors.New("failed to decrypt")
+	}
+	if msg.Src == nil {
+		return nil, errors.New("request is not signed")
+	}
+	req, err := decodeMailRequest(msg.Payload, s.limit)
+	if err != nil {
+		return nil, err
+	}
+	req.src = msg.Src
+	return req, nil
+}
+
+// decodeMailRequest decodes the payload of a mail request. The limit of a
+// paged request is capped at max, unless max is 0.
+func decodeMailRequest(payload []byte, max uint32) (*mailRequest, error) {
+	if len(payload) < requestHeaderSize {
+		return nil, errors.New("undersized request")
+	}
+	req := &mailRequest{
+		from: binary.BigEndian.Uint32(payload),
+		to:   binary.BigEndian.Uint32(payload[4:]),
+	}
+	rest := payload[requestHeaderSize:]
+	if len(rest) == 0 {
+		req.bloom = whisper.MakeFullNodeBloom()
+		return req, nil
+	}
+	if len(rest) < whisper.BloomFilterSize {
+		return nil, errors.New("undersized bloom filter")
+	}
+	req.bloom, rest = rest[:whisper.BloomFilterSize], rest[whisper.BloomFilterSize:]
+	if len(rest) == 0 {
+		return req, nil
+	}
+
+	if len(rest) < 4 {
+		return nil, errors.New("undersized limit")
+	}
+	req.paged = true
+	req.limit, rest = binary.BigEndian.Uint32(rest), rest[4:]
+	if max > 0 && (req.limit == 0 || req.limit > max) {
+		req.limit = max
+	}
+	if len(rest) > 0 {
+		if len(rest) != archiveKeySize {
+			return nil, fmt.Errorf("cursor has %d bytes instead of %d", len(rest), archiveKeySize)
+		}
+		req.cursor = rest
+	}
+	return req, nil
+}
+
+// deliver sends the envelopes of a request with send, up to the limit of
+// the request, and returns how many it sent and where the next page starts.
+func (s *mailServer) deliver(send func(*whisper.Envelope) error, req *mailRequest) (uint32, []byte, error) {
+	start := archiveKey(req.from, common.Hash{})
+	if req.cursor != nil {
+		if bytes.Compare(req.cursor, start) < 0 {
+			return 0, nil, errors.New("cursor precedes the time range")
+		}
+		start = req.cursor
+	}
+	var limit []byte
+	if req.to < ^uint32(0) {
+		// to is inclusive
+		limit = archiveKey(req.to+1, common.Hash{})
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.store == nil {
+		return 0, nil, errors.New("mail server is closed")
+	}
+	var (
+		count   uint32
+		next    []byte
+		sendErr error
+	)
+	err := s.store.Iterate(start, limit, func(key, value []byte) bool {
+		if req.limit > 0 && count == req.limit {
+			next = common.CopyBytes(key)
+			return false
+		}
+		var env whisper.Envelope
+		if err := rlp.DecodeBytes(value, &env); err != nil {
+			s.log.Error("failed to decode archived envelope", "key", fmt.Sprintf("%x", key), "err", err)
+			return true
+		}
+		if !whisper.BloomFilterMatch(req.bloom, env.Bloom()) {
+			return true
+		}
+		if sendErr = send(&env); sendErr != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if sendErr != nil {
+		return count, nil, sendErr
+	}
+	return count, next, err
+}
+
+// sendPage sends a page marker to peer.
+func (s *mailServer) sendPage(peer *whisper.Peer, page *mailPage) error {
+	payload, err := rlp.EncodeToBytes(page)
+	if err != nil {
+		return err
+	}
+	params := &whisper.MessageParams{
+		TTL:     whisper.DefaultTTL,
+		KeySym:  s.key,
+		Topic:   mailPageTopic,
+		Payload: append([]byte(mailPageMagic), payload...),
+	}
+	msg, err := whisper.NewSentMessage(params)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	env, err := msg.Wrap(params)
+	s.metrics.observePoW(start)
+	if err != nil {
+		return err
+	}
+	return s.shh.SendP2PDirect(peer, env)
+}
+
+// decodeMailPage decodes the payload of a page marker.
+func decodeMailPage(payload []byte) (*mailPage, error) {
+	if !bytes.HasPrefix(payload, []byte(mailPageMagic)) {
+		return nil, errors.New("not a page marker")
+	}
+	page := new(mailPage)
+	if err := rlp.DecodeBytes(payload[len(mailPageMagic):], page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
@@ -0,0 +1,184 @@
+package wnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// mailPayload encodes a mail request the way requestMail does.
+func mailPayload(from, to uint32, bloom []byte, limit *uint32, cursor []byte) []byte {
+	payload := make([]byte, requestHeaderSize)
+	binary.BigEndian.PutUint32(payload, from)
+	binary.BigEndian.PutUint32(payload[4:], to)
+	payload = append(payload, bloom...)
+	if limit != nil {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], *limit)
+		payload = append(payload, l[:]...)
+	}
+	return append(payload, cursor...)
+}
+
+func TestDecodeMailRequest(t *testing.T) {
+	bloom := whisper.TopicToBloom(whisper.BytesToTopic([]byte("test")))
+	limit := func(l uint32) *uint32 { return &l }
+	cursor := archiveKey(100, common.Hash{1})
+
+	tests := []struct {
+		name    string
+		payload []byte
+		max     uint32
+		paged   bool
+		limit   uint32
+		cursor  []byte
+		fails   bool
+	}{
+		{name: "undersized", payload: []byte{1, 2, 3}, fails: true},
+		{name: "time range only", payload: mailPayload(1, 2, nil, nil, nil)},
+		{name: "undersized bloom", payload: mailPayload(1, 2, bloom[:10], nil, nil), fails: true},
+		{name: "unpaged", payload: mailPayload(1, 2, bloom, nil, nil)},
+		{name: "undersized limit", payload: append(mailPayload(1, 2, bloom, nil, nil), 0, 1), fails: true},
+		{name: "paged", payload: mailPayload(1, 2, bloom, limit(10), nil), paged: true, limit: 10},
+		{name: "limit capped", payload: mailPayload(1, 2, bloom, limit(10), nil), max: 5, paged: true, limit: 5},
+		{name: "no limit capped", payload: mailPayload(1, 2, bloom, limit(0), nil), max: 5, paged: true, limit: 5},
+		{name: "no limit uncapped", payload: mailPayload(1, 2, bloom, limit(0), nil), paged: true, limit: 0},
+		{name: "cursor", payload: mailPayload(1, 200, bloom, limit(10), cursor), paged: true, limit: 10, cursor: cursor},
+		{name: "short cursor", payload: mailPayload(1, 200, bloom, limit(10), cursor[:5]), fails: true},
+	}
+	for _, test := range tests {
+		req, err := decodeMailRequest(test.payload, test.max)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: decoded an invalid request", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if req.from != 1 || req.paged != test.paged || req.limit != test.limit || !bytes.Equal(req.cursor, test.cursor) {
+			t.Errorf("%s: got from %d, paged %v, limit %d, cursor %x", test.name, req.from, req.paged, req.limit, req.cursor)
+		}
+		if len(req.bloom) != whisper.BloomFilterSize {
+			t.Errorf("%s: bloom of %d bytes", test.name, len(req.bloom))
+		}
+	}
+}
+
+// newTestMailServer returns a mail server with a memory store holding an
+// envelope sent at every time of sent, on topic a at even and on topic b
+// at odd times.
+func newTestMailServer(t *testing.T, sent ...uint32) *mailServer {
+	store, err := OpenStore(StoreMemory, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mailServer{store: store, log: log.Root()}
+	for _, at := range sent {
+		topic := whisper.BytesToTopic([]byte("a"))
+		if at%2 == 1 {
+			topic = whisper.BytesToTopic([]byte("b"))
+		}
+		s.Archive(&whisper.Envelope{Expiry: at + 10, TTL: 10, Topic: topic, Data: []byte{byte(at)}})
+	}
+	return s
+}
+
+// deliverTimes delivers req and returns the send times of the envelopes.
+func deliverTimes(t *testing.T, s *mailServer, req *mailRequest) ([]uint32, []byte) {
+	var times []uint32
+	send := func(env *whisper.Envelope) error {
+		times = append(times, env.Expiry-env.TTL)
+		return nil
+	}
+	count, next, err := s.deliver(send, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(count) != len(times) {
+		t.Errorf("count %d, but %d envelopes sent", count, len(times))
+	}
+	return times, next
+}
+
+func TestDeliverPages(t *testing.T) {
+	s := newTestMailServer(t, 10, 11, 12, 13, 14, 15, 16)
+	defer s.store.Close()
+
+	// pages of two from 11 to 15, following the cursors
+	req := &mailRequest{from: 11, to: 15, bloom: whisper.MakeFullNodeBloom(), paged: true, limit: 2}
+	var pages [][]uint32
+	for {
+		times, next := deliverTimes(t, s, req)
+		pages = append(pages, times)
+		if next == nil {
+			break
+		}
+		if len(pages) > 5 {
+			t.Fatal("cursor does not advance")
+		}
+		req.cursor = next
+	}
+	if want := [][]uint32{{11, 12}, {13, 14}, {15}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+}
+
+func TestDeliverBloom(t *testing.T) {
+	s := newTestMailServer(t, 10, 11, 12, 13, 14)
+	defer s.store.Close()
+
+	// the envelopes of other topics do not count towards the limit
+	bloom := whisper.TopicToBloom(whisper.BytesToTopic([]byte("b")))
+	req := &mailRequest{from: 10, to: 14, bloom: bloom, paged: true, limit: 1}
+	times, next := deliverTimes(t, s, req)
+	if len(times) != 1 || times[0] != 11 {
+		t.Errorf("first page: got %v, want [11]", times)
+	}
+	req.cursor = next
+	times, next = deliverTimes(t, s, req)
+	if len(times) != 1 || times[0] != 13 {
+		t.Errorf("second page: got %v, want [13]", times)
+	}
+	req.cursor = next
+	if times, next = deliverTimes(t, s, req); len(times) != 0 || next != nil {
+		t.Errorf("last page: got %v and cursor %x, want nothing", times, next)
+	}
+}
+
+func TestDeliverCursorOutOfRange(t *testing.T) {
+	s := newTestMailServer(t, 10, 11)
+	defer s.store.Close()
+
+	req := &mailRequest{from: 11, to: 20, bloom: whisper.MakeFullNodeBloom(), paged: true, cursor: archiveKey(10, common.Hash{})}
+	send := func(*whisper.Envelope) error { return nil }
+	if _, _, err := s.deliver(send, req); err == nil {
+		t.Error("cursor before the time range accepted")
+	}
+}
+
+func TestMailPage(t *testing.T) {
+	page := &mailPage{Request: common.Hash{1}, Count: 2, Cursor: archiveKey(3, common.Hash{4})}
+	raw, err := rlp.EncodeToBytes(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeMailPage(append([]byte(mailPageMagic), raw...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Request != page.Request || got.Count != page.Count || !bytes.Equal(got.Cursor, page.Cursor) {
+		t.Errorf("got %+v, want %+v", got, page)
+	}
+	if _, err := decodeMailPage(raw); err == nil {
+		t.Error("decoded a payload without the magic")
+	}
+}
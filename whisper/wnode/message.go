@@ -0,0 +1,143 @@
+package wnode
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Message is a received and decrypted whisper message.
+type Message struct {
+	Hash         common.Hash       // hash of the envelope the message came in
+	Subscription string            // name of the subscription that received the message
+	Topic        whisper.TopicType // topic of the envelope
+	Sender       common.Address    // address of the signer, zero if the message is not signed
+	SenderKey    *ecdsa.PublicKey  // public key of the signer, nil if the message is not signed
+	Sent         time.Time         // time the message was sent
+	TTL          uint32            // time-to-live in seconds
+	PoW          float64           // proof of work of the envelope
+	Payload      []byte            // decrypted payload
+}
+
+// SendOptions override the node configuration for a single message.
+// Zero values fall back to the node defaults.
+type SendOptions struct {
+	Topic    *whisper.TopicType // topic of the message
+	SymKey   []byte             // symmetric key, if the message should be encrypted symmetrically
+	PubKey   *ecdsa.PublicKey   // public key of the recipient, if the message should be encrypted asymmetrically
+	TTL      uint32             // time-to-live in seconds
+	PoW      float64            // PoW target
+	WorkTime uint32             // maximum time in seconds spent on PoW
+}
+
+func newMessage(msg *whisper.ReceivedMessage, subscription string) *Message {
+	m := &Message{
+		Subscription: subscription,
+		Hash:         msg.EnvelopeHash,
+		Topic:        msg.Topic,
+		SenderKey:    msg.Src,
+		Sent:         time.Unix(int64(msg.Sent), 0),
+		TTL:          msg.TTL,
+		PoW:          msg.PoW,
+		Payload:      msg.Payload,
+	}
+	if msg.Src != nil {
+		m.Sender = crypto.PubkeyToAddress(*msg.Src)
+	}
+	return m
+}
+
+// Messages returns the channel all messages matching the node's filters are
+// delivered to, as soon as they arrive. The channel buffers up to
+// Config.ArgBufferSize messages. When the reader falls behind and the buffer
+// is full, the oldest buffered message is discarded to make room for the new
+// one; Dropped counts the discarded messages. The channel is the same from
+// NewNode on, so it can be selected on before Start, and it is closed when
+// the node is stopped.
+func (n *Node) Messages() <-chan *Message {
+	return n.messages
+}
+
+// Send seals the payload into an envelope and posts it to the network.
+// It returns the hash of the envelope. The proof of work may take up to
+// the configured work time; Send gives up earlier if ctx is done.
+func (n *Node) Send(ctx context.Context, payload []byte, opts *SendOptions) (common.Hash, error) {
+	if !n.running() {
+		return common.Hash{}, ErrNotStarted
+	}
+	if opts == nil {
+		opts = &SendOptions{}
+	}
+
+	params := whisper.MessageParams{
+		Src:      n.asymKey,
+		Dst:      n.pub,
+		KeySym:   n.symKey,
+		Payload:  payload,
+		Topic:    n.Topic(),
+		TTL:      uint32(n.config.ArgTTL),
+		PoW:      n.config.ArgPoW,
+		WorkTime: uint32(n.config.ArgWorkTime),
+	}
+	if opts.Topic != nil {
+		params.Topic = *opts.Topic
+	}
+	if opts.PubKey != nil {
+		params.Dst, params.KeySym = opts.PubKey, nil
+	} else if opts.SymKey != nil {
+		params.Dst, params.KeySym = nil, opts.SymKey
+	}
+	if opts.TTL != 0 {
+		params.TTL = opts.TTL
+	}
+	if opts.PoW != 0 {
+		params.PoW = opts.PoW
+	}
+	if opts.WorkTime != 0 {
+		params.WorkTime = opts.WorkTime
+	}
+	if params.Dst == nil && params.KeySym == nil {
+		return common.Hash{}, &KeyError{"recipient", errors.New("neither symmetric key nor public key of the recipient is set")}
+	}
+
+	msg, err := whisper.NewSentMessage(&params)
+	if err != nil {
+		return common.Hash{}, &NetworkError{"send", err}
+	}
+
+	type result struct {
+		env *whisper.Envelope
+		err error
+	}
+	sealed := make(chan result, 1)
+	go func() {
+		start := time.Now()
+		env, err := msg.Wrap(&params)
+		n.metrics.observePoW(start)
+		sealed <- result{env, err}
+	}()
+
+	var envelope *whisper.Envelope
+	select {
+	case r := <-sealed:
+		if r.err != nil {
+			return common.Hash{}, &NetworkError{"send", r.err}
+		}
+		envelope = r.env
+	case <-ctx.Done():
+		return common.Hash{}, ctx.Err()
+	}
+
+	sent := n.metrics.sending(envelope.Hash())
+	err = n.shh.Send(envelope)
+	sent()
+	if err != nil {
+		return common.Hash{}, &NetworkError{"send", err}
+	}
+	return envelope.Hash(), nil
+}
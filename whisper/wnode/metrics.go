@@ -0,0 +1,283 @@
+package wnode
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// metricsNamespace prefixes the names of the metrics, e.g. wnode_peers.
+	metricsNamespace = "wnode"
+
+	// archiveStatsInterval is how long the size of the archive is cached:
+	// measuring it reads the whole store.
+	archiveStatsInterval = time.Minute
+
+	// otherTopic labels the envelopes of the topics the node is not
+	// subscribed to. Any peer can make up topics, so labelling them all
+	// would grow the metrics without bound.
+	otherTopic = "other"
+)
+
+// Results of mail requests, the label of wnode_mail_requests_total.
+const (
+	mailServed  = "served"  // envelopes delivered
+	mailRefused = "refused" // requester not allowed or rate limited
+	mailFailed  = "failed"  // delivery interrupted by an error
+	mailInvalid = "invalid" // request could not be decrypted or decoded
+)
+
+// nodeMetrics are the Prometheus metrics of a node, served at
+// Config.ArgMetricsAddr. Every node has a registry of its own, so several
+// nodes in one process keep their numbers apart.
+type nodeMetrics struct {
+	registry *prometheus.Registry
+
+	sent            *prometheus.CounterVec // by subscribed topic
+	received        *prometheus.CounterVec // by subscribed topic
+	expired         *prometheus.CounterVec // by subscribed topic
+	pow             prometheus.Histogram
+	decryptFailures prometheus.Counter
+	mailRequests    *prometheus.CounterVec // by result
+	mailDelivered   prometheus.Counter
+
+	mu         sync.Mutex
+	own        map[common.Hash]bool         // envelopes the node is sending
+	expiries   map[uint32]map[string]uint64 // envelopes in the pool by expiry and topic label
+	subscribed func(whisper.TopicType) bool
+
+	archiveMu sync.Mutex // held while the archive is measured
+	archive   archiveStats
+
+	log  log.Logger
+	http *http.Server
+	url  string
+}
+
+// archiveStats is the cached size of the archive.
+type archiveStats struct {
+	envelopes int
+	size      int64
+	time      time.Time
+}
+
+func newNodeMetrics(n *Node) *nodeMetrics {
+	m := &nodeMetrics{
+		registry: prometheus.NewRegistry(),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "envelopes_sent_total",
+			Help:      "Envelopes sent by the node.",
+		}, []string{"topic"}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "envelopes_received_total",
+			Help:      "Envelopes received from peers and added to the pool.",
+		}, []string{"topic"}),
+		expired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "envelopes_expired_total",
+			Help:      "Envelopes of the pool that reached their expiry.",
+		}, []string{"topic"}),
+		pow: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "pow_seconds",
+			Help:      "Time spent sealing envelopes with proof of work.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+		decryptFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "decryption_failures_total",
+			Help:      "Envelopes matching a subscription that failed to decrypt.",
+		}),
+		mailRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "mail_requests_total",
+			Help:      "History requests received by the mail server.",
+		}, []string{"result"}),
+		mailDelivered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "mail_envelopes_delivered_total",
+			Help:      "Archived envelopes delivered by the mail server.",
+		}),
+		own:        make(map[common.Hash]bool),
+		expiries:   make(map[uint32]map[string]uint64),
+		subscribed: n.subscribed,
+		log:        n.log,
+	}
+	m.registry.MustRegister(m.sent, m.received, m.expired, m.pow, m.decryptFailures,
+		prometheus.NewGoCollector(),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "peers",
+			Help:      "Connected peers.",
+		}, func() float64 { return float64(n.server.PeerCount()) }),
+	)
+	if n.config.MailServerMode {
+		m.registry.MustRegister(m.mailRequests, m.mailDelivered,
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "archive_envelopes",
+				Help:      "Envelopes in the mail server archive.",
+			}, func() float64 { return float64(m.archiveStats(&n.mailServer).envelopes) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Name:      "archive_bytes",
+				Help:      "Size of the keys and values in the mail server archive.",
+			}, func() float64 { return float64(m.archiveStats(&n.mailServer).size) }),
+		)
+	}
+	return m
+}
+
+// sending marks the envelope with hash as the node's own until the
+// returned function is called, so it is counted as sent, not received.
+func (m *nodeMetrics) sending(hash common.Hash) func() {
+	m.mu.Lock()
+	m.own[hash] = true
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		delete(m.own, hash)
+		m.mu.Unlock()
+	}
+}
+
+// envelopeAdded counts an envelope whisper added to its pool and keeps
+// track of it until it expires.
+func (m *nodeMetrics) envelopeAdded(env *whisper.Envelope) {
+	topic := m.topicLabel(env.Topic)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.own[env.Hash()] {
+		m.sent.WithLabelValues(topic).Inc()
+	} else {
+		m.received.WithLabelValues(topic).Inc()
+	}
+	topics := m.expiries[env.Expiry]
+	if topics == nil {
+		topics = make(map[string]uint64)
+		m.expiries[env.Expiry] = topics
+	}
+	topics[topic]++
+	m.expire(time.Now())
+}
+
+// topicLabel returns the label of topic: the topic itself if the node is
+// subscribed to it, otherTopic if not.
+func (m *nodeMetrics) topicLabel(topic whisper.TopicType) string {
+	if m.subscribed(topic) {
+		return topic.String()
+	}
+	return otherTopic
+}
+
+// expire counts the envelopes that expired by now. It is called as
+// envelopes arrive and before the metrics are gathered.
+func (m *nodeMetrics) expire(now time.Time) {
+	t := uint32(now.Unix())
+	for expiry, topics := range m.expiries {
+		if expiry >= t {
+			continue
+		}
+		for topic, count := range topics {
+			m.expired.WithLabelValues(topic).Add(float64(count))
+		}
+		delete(m.expiries, expiry)
+	}
+}
+
+// observePoW records the time spent in msg.Wrap since start.
+func (m *nodeMetrics) observePoW(start time.Time) {
+	m.pow.Observe(time.Since(start).Seconds())
+}
+
+// mailRequest counts a request served by the mail server.
+func (m *nodeMetrics) mailRequest(result string, delivered uint32) {
+	m.mailRequests.WithLabelValues(result).Inc()
+	m.mailDelivered.Add(float64(delivered))
+}
+
+// archiveStats returns the size of the archive of s, measured at most once
+// per archiveStatsInterval.
+func (m *nodeMetrics) archiveStats(s *mailServer) archiveStats {
+	m.archiveMu.Lock()
+	defer m.archiveMu.Unlock()
+	if time.Since(m.archive.time) < archiveStatsInterval {
+		return m.archive
+	}
+	envelopes, size, err := s.size()
+	if err != nil {
+		m.log.Warn("failed to measure the mail server database", "err", err)
+		return m.archive
+	}
+	m.archive = archiveStats{envelopes, size, time.Now()}
+	return m.archive
+}
+
+// Gather brings the expired envelopes up to date and gathers the metrics.
+func (m *nodeMetrics) Gather() ([]*dto.MetricFamily, error) {
+	m.mu.Lock()
+	m.expire(time.Now())
+	m.mu.Unlock()
+	return m.registry.Gather()
+}
+
+// size returns the number of envelopes in the store and the size of their
+// keys and values.
+func (s *mailServer) size() (int, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.store == nil {
+		return 0, 0, nil
+	}
+	var envelopes int
+	var size int64
+	err := s.store.Iterate(nil, nil, func(key, value []byte) bool {
+		envelopes++
+		size += int64(len(key) + len(value))
+		return true
+	})
+	return envelopes, size, err
+}
+
+// startMetrics serves the metrics of the node at Config.ArgMetricsAddr.
+func (n *Node) startMetrics() error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(n.metrics, promhttp.HandlerOpts{}))
+	n.metrics.http = &http.Server{Handler: mux}
+	addr, err := serve(n.metrics.http, n.config.ArgMetricsAddr)
+	if err != nil {
+		return &NetworkError{"start metrics", err}
+	}
+	n.metrics.url = "http://" + addr + "/metrics"
+	n.log.Info("metrics served", "url", n.metrics.url)
+	if n.interactive {
+		fmt.Printf("Metrics served on %s \n", n.metrics.url)
+	}
+	return nil
+}
+
+func (n *Node) stopMetrics() {
+	if n.metrics != nil && n.metrics.http != nil {
+		n.metrics.http.Close()
+	}
+}
+
+// MetricsURL returns the URL of the Prometheus metrics, or an empty string
+// if they are not served.
+func (n *Node) MetricsURL() string {
+	if n.metrics == nil {
+		return ""
+	}
+	return n.metrics.url
+}
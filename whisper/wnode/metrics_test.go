@@ -0,0 +1,79 @@
+package wnode
+
+import (
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTopicLabel(t *testing.T) {
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+
+	own := whisper.BytesToTopic([]byte("test"))
+	extra := whisper.BytesToTopic([]byte("xtra"))
+	if got := n.metrics.topicLabel(own); got != own.String() {
+		t.Errorf("subscribed topic labelled %q", got)
+	}
+	if got := n.metrics.topicLabel(extra); got != otherTopic {
+		t.Errorf("unknown topic labelled %q, want %q", got, otherTopic)
+	}
+	if err := n.Subscribe("extra", SubscriptionConfig{Topics: []whisper.TopicType{extra}, SymPass: "extra"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.metrics.topicLabel(extra); got != extra.String() {
+		t.Errorf("newly subscribed topic labelled %q", got)
+	}
+}
+
+func TestEnvelopeMetrics(t *testing.T) {
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+	m := n.metrics
+
+	own := whisper.BytesToTopic([]byte("test"))
+	expiry := uint32(time.Now().Unix()) + 100
+	envelope := func(topic string, data byte) *whisper.Envelope {
+		return &whisper.Envelope{Expiry: expiry, TTL: 100, Topic: whisper.BytesToTopic([]byte(topic)), Data: []byte{data}}
+	}
+
+	sent := envelope("test", 1)
+	done := m.sending(sent.Hash())
+	m.envelopeAdded(sent)
+	done()
+	m.envelopeAdded(envelope("test", 2))
+	for i := byte(0); i < 3; i++ {
+		m.envelopeAdded(envelope(string([]byte{'o', 't', 'h', i}), i))
+	}
+
+	counts := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"sent", testutil.ToFloat64(m.sent.WithLabelValues(own.String())), 1},
+		{"received", testutil.ToFloat64(m.received.WithLabelValues(own.String())), 1},
+		{"received of other topics", testutil.ToFloat64(m.received.WithLabelValues(otherTopic)), 3},
+		{"expired", testutil.ToFloat64(m.expired.WithLabelValues(own.String())), 0},
+	}
+	for _, c := range counts {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+
+	m.mu.Lock()
+	m.expire(time.Unix(int64(expiry)+1, 0))
+	m.mu.Unlock()
+	if got := testutil.ToFloat64(m.expired.WithLabelValues(own.String())); got != 2 {
+		t.Errorf("expired: got %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.expired.WithLabelValues(otherTopic)); got != 3 {
+		t.Errorf("expired of other topics: got %v, want 3", got)
+	}
+	if got := testutil.CollectAndCount(m.received); got != 2 {
+		t.Errorf("received counted under %d labels, want 2", got)
+	}
+}
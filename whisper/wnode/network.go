@@ -0,0 +1,83 @@
+package wnode
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/nat"
+)
+
+// Default limits of connected peers, if Config.ArgMaxPeers is 0. A
+// bootstrap node takes the connections of all the nodes it introduces.
+const (
+	defaultMaxPeers     = 80
+	defaultBootMaxPeers = 800
+)
+
+// natInterface returns the port mapping of c.ArgNAT, or of the IP address
+// of c.ArgAdvertise. The mechanism is detected if neither is set.
+func (c *Config) natInterface() (nat.Interface, error) {
+	if len(c.ArgAdvertise) > 0 {
+		ip, _, err := parseAdvertise(c.ArgAdvertise)
+		if err != nil {
+			return nil, err
+		}
+		return nat.ExtIP(ip), nil
+	}
+	if len(c.ArgNAT) == 0 {
+		return nat.Any(), nil
+	}
+	return nat.Parse(c.ArgNAT)
+}
+
+// maxPeers returns the maximum number of connected peers.
+func (c *Config) maxPeers() int {
+	switch {
+	case c.ArgMaxPeers > 0:
+		return int(c.ArgMaxPeers)
+	case c.connectsToPeers():
+		return defaultMaxPeers
+	default:
+		return defaultBootMaxPeers
+	}
+}
+
+// parseAdvertise parses an advertised address: an IP address, with an
+// optional port. The port is 0 if it is the port the node listens on.
+func parseAdvertise(s string) (net.IP, int, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, 0, nil
+	}
+	host, p, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, errors.New("invalid IP address " + host)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 0xFFFF {
+		return nil, 0, errors.New("invalid port " + p)
+	}
+	return ip, port, nil
+}
+
+// self returns the node record other nodes reach the node at: the
+// advertised address if there is one, its listen address otherwise.
+func (n *Node) self() *discover.Node {
+	self := *n.server.Self()
+	if len(n.config.ArgAdvertise) > 0 {
+		// without discovery geth ignores the NAT interface, and it always
+		// keeps the port it listens on
+		if ip, port, err := parseAdvertise(n.config.ArgAdvertise); err == nil {
+			self.IP = ip
+			if port > 0 {
+				self.TCP, self.UDP = uint16(port), uint16(port)
+			}
+		}
+	}
+	return &self
+}
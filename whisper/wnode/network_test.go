@@ -0,0 +1,99 @@
+package wnode
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseAdvertise(t *testing.T) {
+	tests := []struct {
+		addr  string
+		ip    string
+		port  int
+		fails bool
+	}{
+		{addr: "203.0.113.7", ip: "203.0.113.7"},
+		{addr: "203.0.113.7:30400", ip: "203.0.113.7", port: 30400},
+		{addr: "2001:db8::1", ip: "2001:db8::1"},
+		{addr: "[2001:db8::1]:30400", ip: "2001:db8::1", port: 30400},
+		{addr: "node.example.org", fails: true},
+		{addr: "node.example.org:30400", fails: true},
+		{addr: "203.0.113.7:0", fails: true},
+		{addr: "203.0.113.7:65536", fails: true},
+		{addr: "203.0.113.7:port", fails: true},
+	}
+	for _, test := range tests {
+		ip, port, err := parseAdvertise(test.addr)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: parsed as %v port %d", test.addr, ip, port)
+			}
+			continue
+		}
+		if err != nil || !ip.Equal(net.ParseIP(test.ip)) || port != test.port {
+			t.Errorf("%s: got %v port %d, %v", test.addr, ip, port, err)
+		}
+	}
+}
+
+func TestNATInterface(t *testing.T) {
+	// the mechanism is detected if neither is set
+	c := testConfig()
+	c.ArgNAT = ""
+	if m, err := c.natInterface(); m == nil || err != nil {
+		t.Errorf("default: got %v, %v", m, err)
+	}
+
+	tests := []struct {
+		nat, advertise string
+		want           string
+	}{
+		{"none", "", "<nil>"},
+		{"extip:198.51.100.1", "", "ExtIP(198.51.100.1)"},
+		{"", "203.0.113.7:30400", "ExtIP(203.0.113.7)"},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.ArgNAT, c.ArgAdvertise = test.nat, test.advertise
+		m, err := c.natInterface()
+		if err != nil {
+			t.Errorf("nat %q, advertise %q: %v", test.nat, test.advertise, err)
+		} else if got := fmt.Sprint(m); got != test.want {
+			t.Errorf("nat %q, advertise %q: got %s, want %s", test.nat, test.advertise, got, test.want)
+		}
+	}
+}
+
+func TestMaxPeers(t *testing.T) {
+	c := testConfig()
+	if got := c.maxPeers(); got != defaultMaxPeers {
+		t.Errorf("plain node: %d peers, want %d", got, defaultMaxPeers)
+	}
+	c.BootstrapMode = true
+	if got := c.maxPeers(); got != defaultBootMaxPeers {
+		t.Errorf("bootstrap node: %d peers, want %d", got, defaultBootMaxPeers)
+	}
+	c.ArgMaxPeers = 5
+	if got := c.maxPeers(); got != 5 {
+		t.Errorf("configured: %d peers, want 5", got)
+	}
+}
+
+func TestAdvertisedEnode(t *testing.T) {
+	for _, advertise := range []string{"203.0.113.7:30400", "203.0.113.7"} {
+		c := testConfig()
+		c.ArgNAT, c.ArgAdvertise = "", advertise
+		n := startTestNode(t, c)
+		enode := n.Enode()
+		_, port, _ := net.SplitHostPort(n.server.ListenAddr)
+		if advertise == "203.0.113.7:30400" {
+			port = "30400"
+		}
+		if want := "@203.0.113.7:" + port; !strings.Contains(enode, want) {
+			t.Errorf("advertise %s: enode %s, want it at %s", advertise, enode, want)
+		}
+		n.Stop()
+	}
+}
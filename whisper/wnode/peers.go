@@ -0,0 +1,336 @@
+package wnode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+const (
+	// peerDialTime is how long a static peer gets to connect before it is
+	// given up for its backoff.
+	peerDialTime = 10 * time.Second
+
+	// minPeerBackoff and maxPeerBackoff bound the time a static peer waits
+	// between two connection attempts. geth does not dial a node again
+	// within 30 seconds of the last attempt anyway.
+	minPeerBackoff = 30 * time.Second
+	maxPeerBackoff = 10 * time.Minute
+
+	// peerCheckInterval is how often the static peers are checked.
+	peerCheckInterval = time.Second
+)
+
+// Origins of static peers.
+const (
+	PeerBoot   = "boot"   // Config.ArgEnode
+	PeerStatic = "static" // Config.ArgStaticPeers
+	PeerAdded  = "added"  // added at runtime, persisted in Config.ArgPeersFile
+)
+
+// PeerStatus describes a static peer of the node.
+type PeerStatus struct {
+	Enode     string    `json:"enode"`
+	Origin    string    `json:"origin"`
+	Connected bool      `json:"connected"`
+	Retry     time.Time `json:"retry,omitempty"` // next connection attempt, if not connected
+}
+
+// staticPeer is a peer the node keeps connected to. While it is not
+// connected, it is dialed for peerDialTime, then left alone for its
+// backoff, which doubles with every failed attempt.
+type staticPeer struct {
+	node      *discover.Node
+	origin    string
+	connected bool
+	dialing   time.Time // start of the current attempt, zero if none
+	backoff   time.Duration
+	next      time.Time // start of the next attempt
+}
+
+// peerManager keeps the static peers of a node connected. geth redials its
+// own static nodes every 30 seconds forever; the manager rather adds a peer
+// to geth for one attempt at a time, and removes it in between.
+type peerManager struct {
+	server *p2p.Server
+	file   string // Config.ArgPeersFile
+	log    log.Logger
+
+	mu    sync.Mutex
+	peers map[discover.NodeID]*staticPeer
+}
+
+func newPeerManager(server *p2p.Server, file string, logger log.Logger) *peerManager {
+	return &peerManager{
+		server: server,
+		file:   file,
+		log:    logger,
+		peers:  make(map[discover.NodeID]*staticPeer),
+	}
+}
+
+// parseEnodes parses a comma separated list of enodes; the enode:// prefix
+// is optional.
+func parseEnodes(s string) ([]*discover.Node, error) {
+	var nodes []*discover.Node
+	for _, e := range splitList(s) {
+		node, err := discover.ParseNode(normalizeEnode(e))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", e, err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// loadPeers reads a file of enodes, one per line. Empty lines and lines
+// starting with # are skipped. A missing file holds no peers.
+func loadPeers(path string) ([]*discover.Node, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var nodes []*discover.Node
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 || strings.HasPrefix(s, "#") {
+			continue
+		}
+		node, err := discover.ParseNode(normalizeEnode(s))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, scanner.Err()
+}
+
+// add makes node a static peer of the given origin, dialed right away. It
+// reports whether the node was not a static peer yet.
+func (m *peerManager) add(node *discover.Node, origin string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.peers[node.ID]; ok {
+		return false
+	}
+	m.peers[node.ID] = &staticPeer{node: node, origin: origin}
+	return true
+}
+
+// remove stops keeping node connected and disconnects it. It returns the
+// origin of the peer, empty if it was not a static peer.
+func (m *peerManager) remove(id discover.NodeID) string {
+	m.mu.Lock()
+	p, ok := m.peers[id]
+	delete(m.peers, id)
+	m.mu.Unlock()
+	if !ok {
+		return ""
+	}
+	m.server.RemovePeer(p.node)
+	return p.origin
+}
+
+// status returns the static peers, ordered by enode.
+func (m *peerManager) status() []*PeerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := make([]*PeerStatus, 0, len(m.peers))
+	for _, p := range m.peers {
+		s := &PeerStatus{Enode: p.node.String(), Origin: p.origin, Connected: p.connected}
+		if !p.connected && p.dialing.IsZero() {
+			s.Retry = p.next
+		}
+		peers = append(peers, s)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Enode < peers[j].Enode })
+	return peers
+}
+
+// event updates the static peers with a peer event of the server.
+func (m *peerManager) event(ev *p2p.PeerEvent, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.peers[ev.Peer]
+	if !ok {
+		return
+	}
+	switch ev.Type {
+	case p2p.PeerEventTypeAdd:
+		p.connected, p.dialing, p.backoff = true, time.Time{}, 0
+	case p2p.PeerEventTypeDrop:
+		// the server would redial the peer on its own schedule
+		p.connected, p.dialing = false, time.Time{}
+		p.backoff = minPeerBackoff
+		p.next = now.Add(p.backoff)
+		go m.server.RemovePeer(p.node)
+	}
+}
+
+// dial starts the connection attempts that are due and gives up those
+// that took too long. The server is called without holding mu: it may be
+// busy delivering the events peerLoop waits for.
+func (m *peerManager) dial(now time.Time) {
+	connected := make(map[discover.NodeID]bool)
+	for _, p := range m.server.Peers() {
+		connected[p.ID()] = true
+	}
+
+	var add, remove []*discover.Node
+	m.mu.Lock()
+	for id, p := range m.peers {
+		switch {
+		case p.connected:
+		case connected[id]:
+			// the event is on its way
+		case p.dialing.IsZero() && !now.Before(p.next):
+			p.dialing = now
+			add = append(add, p.node)
+		case !p.dialing.IsZero() && now.Sub(p.dialing) >= peerDialTime:
+			p.dialing = time.Time{}
+			p.backoff *= 2
+			if p.backoff < minPeerBackoff {
+				p.backoff = minPeerBackoff
+			} else if p.backoff > maxPeerBackoff {
+				p.backoff = maxPeerBackoff
+			}
+			p.next = now.Add(p.backoff)
+			remove = append(remove, p.node)
+			m.log.Debug("static peer unreachable", "peer", id.TerminalString(), "retry", p.backoff)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, node := range add {
+		m.server.AddPeer(node)
+	}
+	for _, node := range remove {
+		m.server.RemovePeer(node)
+	}
+}
+
+// save writes the peers added at runtime to the peers file, if there is
+// one. The file is replaced at once, so it is never left half written.
+func (m *peerManager) save() error {
+	if len(m.file) == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	var enodes []string
+	for _, p := range m.peers {
+		if p.origin == PeerAdded {
+			enodes = append(enodes, p.node.String())
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(enodes)
+
+	var b bytes.Buffer
+	b.WriteString("# peers added at runtime, one enode per line\n")
+	for _, e := range enodes {
+		b.WriteString(e + "\n")
+	}
+	tmp := m.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.file)
+}
+
+// peerLoop keeps the static peers connected until the node stops.
+func (n *Node) peerLoop() {
+	events := make(chan *p2p.PeerEvent, 16)
+	sub := n.server.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+	ticker := time.NewTicker(peerCheckInterval)
+	defer ticker.Stop()
+
+	n.peers.dial(time.Now())
+	for {
+		select {
+		case ev := <-events:
+			n.peers.event(ev, time.Now())
+		case <-ticker.C:
+			n.peers.dial(time.Now())
+		case <-sub.Err():
+			return
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// AddPeer makes the node keep connected to the peer with the given enode,
+// reconnecting with backoff when the connection is lost. The peer is
+// written to Config.ArgPeersFile, if set, and restored from there when the
+// node starts again.
+func (n *Node) AddPeer(enode string) error {
+	if !n.running() {
+		return ErrNotStarted
+	}
+	if n.config.FileReader {
+		return &ConfigError{"enode", errors.New("file reader does not connect to peers")}
+	}
+	node, err := discover.ParseNode(normalizeEnode(enode))
+	if err != nil {
+		return &ConfigError{"enode", err}
+	}
+	if !n.peers.add(node, PeerAdded) {
+		return nil
+	}
+	n.log.Info("static peer added", "peer", node.ID.TerminalString())
+	if err := n.peers.save(); err != nil {
+		return &ConfigError{"ArgPeersFile", err}
+	}
+	return nil
+}
+
+// RemovePeer disconnects the peer with the given enode and stops keeping
+// it connected. A boot or static peer of the config comes back when the
+// node starts again; an added one is removed from Config.ArgPeersFile.
+func (n *Node) RemovePeer(enode string) error {
+	if !n.running() {
+		return ErrNotStarted
+	}
+	node, err := discover.ParseNode(normalizeEnode(enode))
+	if err != nil {
+		return &ConfigError{"enode", err}
+	}
+	origin := n.peers.remove(node.ID)
+	if len(origin) == 0 {
+		return &ConfigError{"enode", fmt.Errorf("%s is not a static peer", node.ID.TerminalString())}
+	}
+	n.log.Info("static peer removed", "peer", node.ID.TerminalString(), "origin", origin)
+	if origin == PeerAdded {
+		if err := n.peers.save(); err != nil {
+			return &ConfigError{"ArgPeersFile", err}
+		}
+	}
+	return nil
+}
+
+// StaticPeers returns the peers the node keeps connected to, none before
+// Start.
+func (n *Node) StaticPeers() []*PeerStatus {
+	if !n.running() {
+		return nil
+	}
+	return n.peers.status()
+}
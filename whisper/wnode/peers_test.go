@@ -0,0 +1,106 @@
+package wnode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// unreachableEnode is a node nobody listens for.
+const unreachableEnode = "enode://a979fb575495b8d6db44f750317d0f4622bf4c2aa3365d6af7c284339968eef29b69ad0dce72a4d8db5ebb4968de0e3bec910127f134779fbcb0cb6d3331163c@127.0.0.1:1"
+
+func TestPeerBackoff(t *testing.T) {
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+	m := newPeerManager(n.server, "", log.Root())
+	node := discover.MustParseNode(unreachableEnode)
+	if !m.add(node, PeerStatic) || m.add(node, PeerAdded) {
+		t.Fatal("peer added twice")
+	}
+
+	// every attempt that fails doubles the backoff, up to maxPeerBackoff
+	now := time.Unix(1000, 0)
+	for i, want := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, maxPeerBackoff, maxPeerBackoff} {
+		m.dial(now)
+		if s := m.status()[0]; !s.Retry.IsZero() {
+			t.Fatalf("attempt %d: retry at %v while dialing", i, s.Retry)
+		}
+		m.dial(now.Add(peerDialTime - time.Second))
+		if s := m.status()[0]; !s.Retry.IsZero() {
+			t.Fatalf("attempt %d: given up before peerDialTime", i)
+		}
+		now = now.Add(peerDialTime)
+		m.dial(now)
+		if got := m.status()[0].Retry.Sub(now); got != want {
+			t.Errorf("attempt %d: backoff %v, want %v", i, got, want)
+		}
+		// nothing is dialed before the backoff is over
+		m.dial(now.Add(want - time.Second))
+		if s := m.status()[0]; s.Retry.IsZero() {
+			t.Errorf("attempt %d: dialed before the backoff is over", i)
+		}
+		now = now.Add(want)
+	}
+
+	// a connection resets the backoff, a drop starts over from the minimum
+	m.event(&p2p.PeerEvent{Type: p2p.PeerEventTypeAdd, Peer: node.ID}, now)
+	if s := m.status()[0]; !s.Connected || !s.Retry.IsZero() {
+		t.Errorf("connected peer: %+v", s)
+	}
+	m.event(&p2p.PeerEvent{Type: p2p.PeerEventTypeDrop, Peer: node.ID}, now)
+	if s := m.status()[0]; s.Connected || s.Retry.Sub(now) != minPeerBackoff {
+		t.Errorf("dropped peer: %+v, want retry in %v", s, minPeerBackoff)
+	}
+
+	if origin := m.remove(node.ID); origin != PeerStatic {
+		t.Errorf("removed peer of origin %q", origin)
+	}
+	if len(m.status()) != 0 {
+		t.Error("removed peer still static")
+	}
+}
+
+func TestPeersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "peers")
+	if nodes, err := loadPeers(file); err != nil || nodes != nil {
+		t.Errorf("missing file: got %v, %v", nodes, err)
+	}
+
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+	m := newPeerManager(n.server, file, log.Root())
+	added := discover.MustParseNode(unreachableEnode)
+	m.add(added, PeerAdded)
+	m.add(discover.MustParseNode(n.Enode()), PeerStatic)
+	if err := m.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the peers added at runtime are kept
+	nodes, err := loadPeers(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*discover.Node{added}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("loaded %v, want %v", nodes, want)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("# comment\n\nenode://00@127.0.0.1:1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPeers(file); err == nil {
+		t.Error("loaded an invalid enode")
+	}
+}
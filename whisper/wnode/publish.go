@@ -0,0 +1,183 @@
+package wnode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+const (
+	// publishPath is where Config.ArgPublishAddr serves the NodeInfo.
+	publishPath = "/enode"
+
+	// bootResolveTime is how long Config.ArgBootFrom is retried, as the
+	// boot node may be starting along with the node.
+	bootResolveTime = 30 * time.Second
+
+	// bootResolveInterval is the time between two attempts.
+	bootResolveInterval = time.Second
+
+	// bootRequestTimeout limits a request to a published URL.
+	bootRequestTimeout = 5 * time.Second
+)
+
+// Info returns the node's enode, public key and default topics, as
+// published at Config.ArgPublishFile and Config.ArgPublishAddr.
+func (n *Node) Info() NodeInfo {
+	return NodeInfo{
+		Enode:     n.Enode(),
+		PublicKey: crypto.FromECDSAPub(n.PublicKey()),
+		Topics:    n.Topics(),
+	}
+}
+
+// startPublish writes the NodeInfo to Config.ArgPublishFile and serves it
+// at Config.ArgPublishAddr, for the nodes that resolve their bootstrap
+// nodes with Config.ArgBootFrom. The file is removed when the node stops,
+// so that nobody reads the enode of a node that is gone.
+func (n *Node) startPublish() error {
+	info, err := json.MarshalIndent(n.Info(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(n.config.ArgPublishFile) > 0 {
+		// replaced at once, so a node reading it never sees half of it
+		tmp := n.config.ArgPublishFile + ".tmp"
+		if err := ioutil.WriteFile(tmp, append(info, '\n'), 0644); err != nil {
+			return &ConfigError{"ArgPublishFile", err}
+		}
+		if err := os.Rename(tmp, n.config.ArgPublishFile); err != nil {
+			os.Remove(tmp)
+			return &ConfigError{"ArgPublishFile", err}
+		}
+		n.published = n.config.ArgPublishFile
+		n.log.Info("enode published", "file", n.config.ArgPublishFile)
+	}
+	if len(n.config.ArgPublishAddr) > 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc(publishPath, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(info)
+		})
+		n.publish = &http.Server{Handler: mux}
+		addr, err := serve(n.publish, n.config.ArgPublishAddr)
+		if err != nil {
+			n.publish = nil
+			return &ConfigError{"ArgPublishAddr", err}
+		}
+		n.publishURL = "http://" + addr + publishPath
+		n.log.Info("enode published", "url", n.publishURL)
+		if n.interactive {
+			fmt.Printf("Enode published on %s \n", n.publishURL)
+		}
+	}
+	return nil
+}
+
+// PublishURL returns the URL the NodeInfo is served at, or an empty string
+// if it is not served.
+func (n *Node) PublishURL() string {
+	return n.publishURL
+}
+
+func (n *Node) stopPublish() {
+	if n.publish != nil {
+		n.publish.Close()
+	}
+	if len(n.published) > 0 {
+		if err := os.Remove(n.published); err != nil && !os.IsNotExist(err) {
+			n.log.Warn("failed to remove the published enode", "file", n.published, "err", err)
+		}
+	}
+}
+
+// resolveBoot adds the enodes published at Config.ArgBootFrom to
+// Config.ArgEnode. Sources that are not available yet are retried for
+// bootResolveTime; those still missing then are skipped, unless there is no
+// bootstrap or static peer at all.
+func (n *Node) resolveBoot(ctx context.Context) error {
+	pending := splitList(n.config.ArgBootFrom)
+	enodes := splitList(n.config.ArgEnode)
+	deadline := time.Now().Add(bootResolveTime)
+	var lastErr error
+	for {
+		var failed []string
+		for _, src := range pending {
+			info, err := readNodeInfo(ctx, src)
+			if err != nil {
+				failed = append(failed, src)
+				lastErr = fmt.Errorf("%s: %s", src, err)
+				continue
+			}
+			n.log.Info("bootstrap node resolved", "source", src, "enode", info.Enode)
+			enodes = append(enodes, normalizeEnode(info.Enode))
+		}
+		pending = failed
+		if len(pending) == 0 || time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-time.After(bootResolveInterval):
+		case <-ctx.Done():
+			return &NetworkError{"resolve boot", ctx.Err()}
+		}
+	}
+	n.config.ArgEnode = strings.Join(enodes, ",")
+	if len(pending) > 0 {
+		if len(enodes) == 0 && len(n.config.ArgStaticPeers) == 0 {
+			return &NetworkError{"resolve boot", lastErr}
+		}
+		n.log.Warn("bootstrap nodes not resolved", "sources", strings.Join(pending, ","), "err", lastErr)
+	}
+	return nil
+}
+
+// readNodeInfo reads a published NodeInfo from an http(s) URL or a file.
+func readNodeInfo(ctx context.Context, src string) (*NodeInfo, error) {
+	var data []byte
+	if isURL(src) {
+		req, err := http.NewRequest("GET", src, nil)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, bootRequestTimeout)
+		defer cancel()
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(resp.Status)
+		}
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(src); err != nil {
+			return nil, err
+		}
+	}
+	var info NodeInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	if _, err := discover.ParseNode(info.Enode); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
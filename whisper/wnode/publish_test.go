@@ -0,0 +1,158 @@
+package wnode
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startBootFrom starts a plain node resolving its bootstrap node at src.
+func startBootFrom(t *testing.T, src string) *Node {
+	c := testConfig()
+	c.ArgBootFrom = src
+	p := NewNode(c)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := p.Start(ctx); err != nil {
+		t.Fatalf("failed to start the plain node: %v", err)
+	}
+	return p
+}
+
+// waitBootPeer checks that p resolved the enode of b and connected to it.
+func waitBootPeer(t *testing.T, p, b *Node) {
+	if p.config.ArgEnode != b.Enode() {
+		t.Errorf("resolved %q, want %s", p.config.ArgEnode, b.Enode())
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if peers := p.server.Peers(); len(peers) == 1 && peers[0].ID() == b.server.Self().ID {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("plain node did not connect to the published bootstrap node")
+		}
+	}
+}
+
+func TestPublishFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	boot := testConfig()
+	boot.ArgPublishFile = filepath.Join(dir, "boot.json")
+	b := startTestNode(t, boot)
+	defer b.Stop()
+
+	// the plain node knows the bootstrap node only through the file
+	p := startBootFrom(t, boot.ArgPublishFile)
+	defer p.Stop()
+	waitBootPeer(t, p, b)
+
+	info, err := readNodeInfo(context.Background(), boot.ArgPublishFile)
+	if err != nil || info.Enode != b.Enode() {
+		t.Errorf("published %v, %v; want %s", info, err, b.Enode())
+	}
+	b.Stop()
+	if _, err := os.Stat(boot.ArgPublishFile); !os.IsNotExist(err) {
+		t.Errorf("published file left after Stop: %v", err)
+	}
+}
+
+func TestPublishAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c := testConfig()
+	c.BootstrapMode = true
+	c.ArgIP = "127.0.0.1:0"
+	c.ArgPublishAddr = l.Addr().String()
+	n := NewNode(c)
+	err = n.Start(context.Background())
+	defer n.Stop()
+	if cerr, ok := err.(*ConfigError); !ok || cerr.Field != "ArgPublishAddr" {
+		t.Errorf("got %v, want a ConfigError of ArgPublishAddr", err)
+	}
+}
+
+func TestPublishAddr(t *testing.T) {
+	boot := testConfig()
+	boot.ArgPublishAddr = "127.0.0.1:0"
+	b := startTestNode(t, boot)
+	defer b.Stop()
+	if !strings.HasSuffix(b.PublishURL(), publishPath) {
+		t.Fatalf("published at %q", b.PublishURL())
+	}
+
+	p := startBootFrom(t, b.PublishURL())
+	defer p.Stop()
+	waitBootPeer(t, p, b)
+}
+
+func TestResolveBootRetries(t *testing.T) {
+	b := startTestNode(t, testConfig())
+	defer b.Stop()
+	info, err := json.Marshal(b.Info())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the endpoint is not up for the first two attempts
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(info)
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	p := startBootFrom(t, srv.URL)
+	defer p.Stop()
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("resolved in %d attempts, want 3", n)
+	}
+	if elapsed := time.Since(start); elapsed < 2*bootResolveInterval {
+		t.Errorf("resolved in %v, before two retry intervals", elapsed)
+	}
+	waitBootPeer(t, p, b)
+}
+
+func TestReadNodeInfoInvalid(t *testing.T) {
+	bodies := map[string]string{
+		"not JSON":      "<html>starting</html>",
+		"invalid enode": `{"enode": "enode://00@127.0.0.1:30303"}`,
+		"no enode":      `{}`,
+	}
+	for name, body := range bodies {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		if info, err := readNodeInfo(context.Background(), srv.URL); err == nil {
+			t.Errorf("%s: read %+v", name, info)
+		}
+		srv.Close()
+	}
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, err := readNodeInfo(context.Background(), srv.URL); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("missing endpoint: got %v, want the status", err)
+	}
+}
@@ -0,0 +1,504 @@
+package wnode
+
+import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Archive nodes replicate over the JSON-RPC API rather than whisper: peer-
+// to-peer messages only reach filters, decrypted, so a node can not store
+// the envelopes another archive sends it that way.
+const (
+	// archiveNamespace prefixes the names of the ArchiveAPI methods, e.g.
+	// archive_inventory.
+	archiveNamespace = "archive"
+
+	// inventorySize is the number of keys returned in one inventory.
+	inventorySize = 4096
+
+	// syncBatch is the number of envelopes fetched at once.
+	syncBatch = 256
+
+	// archiveCallWindow is how far the time of a call may be off. Calls
+	// served are remembered that long, so none is served twice.
+	archiveCallWindow = time.Minute
+)
+
+// Reasons the ArchiveAPI refuses a call, besides those of mailAccess.
+var (
+	errCallTime      = errors.New("call time is too far off")
+	errCallSignature = errors.New("invalid call signature")
+	errCallReplayed  = errors.New("call was served already")
+)
+
+// archiveVirtualHosts returns the host names accepted in the Host header of
+// ArchiveAPI calls: localhost, the host of ArgArchiveAddr and those of
+// ArgArchiveHosts. Calls addressed to an IP are always accepted.
+func archiveVirtualHosts(c *Config) []string {
+	hosts := []string{"localhost"}
+	if host, _, err := net.SplitHostPort(c.ArgArchiveAddr); err == nil && len(host) > 0 && net.ParseIP(host) == nil {
+		hosts = append(hosts, host)
+	}
+	return append(hosts, splitList(c.ArgArchiveHosts)...)
+}
+
+// ArchiveAPI lets other archive nodes copy the envelopes of a mail server.
+// It is served by mail servers only, at Config.ArgArchiveAddr, apart from
+// the PublicAPI. Every call is signed with the requester key and passes the
+// allowlist, the rate limit and the request log of mail requests.
+type ArchiveAPI struct {
+	n *Node
+
+	mu   sync.Mutex
+	seen map[string]time.Time // hashes of the calls served, until they expire
+}
+
+func newArchiveAPI(n *Node) *ArchiveAPI {
+	return &ArchiveAPI{n: n, seen: make(map[string]time.Time)}
+}
+
+// InventoryArgs select the envelopes of an inventory.
+type InventoryArgs struct {
+	Time      uint32        `json:"time"`             // unix time of the call
+	Nonce     hexutil.Bytes `json:"nonce"`            // random, tells apart calls made in the same second
+	Signature hexutil.Bytes `json:"signature"`        // signature of the call by the requester key
+	From      uint32        `json:"from"`             // unix time
+	To        uint32        `json:"to"`               // unix time, inclusive
+	Cursor    hexutil.Bytes `json:"cursor,omitempty"` // continues a previous inventory
+}
+
+func (args *InventoryArgs) hash() ([]byte, error) {
+	return archiveCallHash("inventory", args.Time, args.Nonce, args.From, args.To, []byte(args.Cursor))
+}
+
+// Inventory is a page of the keys archived in a time range.
+type Inventory struct {
+	Keys   []hexutil.Bytes `json:"keys"`
+	Cursor hexutil.Bytes   `json:"cursor,omitempty"` // set if there are more keys
+}
+
+// Inventory returns the archive keys, the sending time followed by the
+// hash, of the envelopes archived between From and To, in order. Large
+// ranges are split in pages continued by Cursor.
+func (api *ArchiveAPI) Inventory(ctx context.Context, args InventoryArgs) (*Inventory, error) {
+	hash, err := args.hash()
+	if err != nil {
+		return nil, err
+	}
+	rec := &MailRequestRecord{Method: archiveNamespace + "_inventory", From: args.From, To: args.To, Cursor: args.Cursor}
+	defer api.n.mailServer.access.record(rec)
+	if err := api.authorize(ctx, rec, args.Time, hash, args.Signature); err != nil {
+		return nil, err
+	}
+	if len(args.Cursor) > 0 && len(args.Cursor) != archiveKeySize {
+		return nil, &ConfigError{"cursor", errors.New("invalid cursor")}
+	}
+	keys, err := api.n.mailServer.inventory(inventoryStart(args.From, args.Cursor), archiveRangeLimit(args.To), inventorySize+1)
+	if err != nil {
+		return nil, &MailServerError{"inventory", err}
+	}
+	inv := new(Inventory)
+	if len(keys) > inventorySize {
+		keys = keys[:inventorySize]
+		inv.Cursor = keys[inventorySize-1]
+	}
+	inv.Keys = make([]hexutil.Bytes, len(keys))
+	for i, k := range keys {
+		inv.Keys[i] = k
+	}
+	rec.Delivered = uint32(len(keys))
+	return inv, nil
+}
+
+// EnvelopesArgs select envelopes by their archive keys.
+type EnvelopesArgs struct {
+	Time      uint32          `json:"time"`      // unix time of the call
+	Nonce     hexutil.Bytes   `json:"nonce"`     // random, tells apart calls made in the same second
+	Signature hexutil.Bytes   `json:"signature"` // signature of the call by the requester key
+	Keys      []hexutil.Bytes `json:"keys"`
+}
+
+func (args *EnvelopesArgs) hash() ([]byte, error) {
+	keys := make([][]byte, len(args.Keys))
+	for i, k := range args.Keys {
+		keys[i] = k
+	}
+	return archiveCallHash("envelopes", args.Time, args.Nonce, keys)
+}
+
+// Envelopes returns the RLP encoded envelopes archived under the given
+// keys. Keys not in the archive are skipped.
+func (api *ArchiveAPI) Envelopes(ctx context.Context, args EnvelopesArgs) ([]hexutil.Bytes, error) {
+	hash, err := args.hash()
+	if err != nil {
+		return nil, err
+	}
+	rec := &MailRequestRecord{Method: archiveNamespace + "_envelopes", Limit: uint32(len(args.Keys))}
+	defer api.n.mailServer.access.record(rec)
+	if err := api.authorize(ctx, rec, args.Time, hash, args.Signature); err != nil {
+		return nil, err
+	}
+	if len(args.Keys) > syncBatch {
+		return nil, &ConfigError{"keys", fmt.Errorf("at most %d keys per call", syncBatch)}
+	}
+	envs := make([]hexutil.Bytes, 0, len(args.Keys))
+	for _, key := range args.Keys {
+		raw, err := api.n.mailServer.get(key)
+		if err != nil {
+			return nil, &MailServerError{"fetch", err}
+		}
+		if raw != nil {
+			envs = append(envs, raw)
+		}
+	}
+	rec.Delivered = uint32(len(envs))
+	return envs, nil
+}
+
+// authorize checks that a call made at t is recent, signed and not served
+// before, and passes its signer through the access control of mail
+// requests. The caller of the API is the peer its rate is limited by.
+// Refusals are noted in rec.
+func (api *ArchiveAPI) authorize(ctx context.Context, rec *MailRequestRecord, t uint32, hash, sig []byte) error {
+	rec.Time = time.Now()
+	if remote, ok := ctx.Value("remote").(string); ok {
+		rec.Peer = remote
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			rec.Peer = host
+		}
+	}
+	err := errCallTime
+	if d := rec.Time.Sub(time.Unix(int64(t), 0)); -archiveCallWindow <= d && d <= archiveCallWindow {
+		err = errCallSignature
+		if src, serr := crypto.SigToPub(hash, sig); serr == nil {
+			rec.Requester = crypto.FromECDSAPub(src)
+			err = api.n.mailServer.access.authorize(rec.Peer, src, rec.Time)
+		}
+		if err == nil && !api.firstCall(hash, time.Unix(int64(t), 0).Add(archiveCallWindow), rec.Time) {
+			err = errCallReplayed
+		}
+	}
+	if err != nil {
+		rec.Refused = err.Error()
+	}
+	return err
+}
+
+// firstCall remembers the call of the given hash until it expires and
+// reports whether it is the first one. Expired calls are forgotten.
+func (api *ArchiveAPI) firstCall(hash []byte, expires, now time.Time) bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for h, exp := range api.seen {
+		if now.After(exp) {
+			delete(api.seen, h)
+		}
+	}
+	if _, ok := api.seen[string(hash)]; ok {
+		return false
+	}
+	api.seen[string(hash)] = expires
+	return true
+}
+
+// archiveCallHash returns the hash an ArchiveAPI call is signed over: the
+// method, the time and nonce of the call and its parameters.
+func archiveCallHash(method string, t uint32, nonce []byte, params ...interface{}) ([]byte, error) {
+	raw, err := rlp.EncodeToBytes(append([]interface{}{method, t, nonce}, params...))
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(raw), nil
+}
+
+// archiveCallNonce returns a random nonce for a call of the ArchiveAPI.
+func archiveCallNonce() (hexutil.Bytes, error) {
+	nonce := make([]byte, 16)
+	_, err := crand.Read(nonce)
+	return nonce, err
+}
+
+// signArchiveCall signs a call of the ArchiveAPI with the node's key.
+func (n *Node) signArchiveCall(hash func() ([]byte, error)) (hexutil.Bytes, error) {
+	h, err := hash()
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Sign(h, n.asymKey)
+}
+
+// archiveServer serves the ArchiveAPI over HTTP.
+type archiveServer struct {
+	rpc  *rpc.Server
+	http *http.Server
+	url  string
+}
+
+func (n *Node) startArchiveAPI() error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(archiveNamespace, newArchiveAPI(n)); err != nil {
+		return &NetworkError{"start archive api", err}
+	}
+	s := &archiveServer{rpc: srv, http: rpc.NewHTTPServer(nil, archiveVirtualHosts(n.config), srv)}
+	addr, err := serve(s.http, n.config.ArgArchiveAddr)
+	if err != nil {
+		srv.Stop()
+		return &NetworkError{"start archive api", err}
+	}
+	s.url = "http://" + addr
+	n.archive = s
+	n.log.Info("archive API listening", "url", s.url)
+	if n.interactive {
+		fmt.Printf("Archive API listening on %s \n", s.url)
+	}
+	return nil
+}
+
+func (n *Node) stopArchiveAPI() {
+	if n.archive != nil {
+		n.archive.http.Close()
+		n.archive.rpc.Stop()
+	}
+}
+
+// ArchiveURL returns the URL of the ArchiveAPI, or an empty string if the
+// node does not serve it.
+func (n *Node) ArchiveURL() string {
+	if n.archive == nil {
+		return ""
+	}
+	return n.archive.url
+}
+
+// inventory returns up to max keys archived from start up to, not
+// including, limit. A max of 0 returns them all.
+func (s *mailServer) inventory(start, limit []byte, max int) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.store == nil {
+		return nil, errors.New("mail server is closed")
+	}
+	var keys [][]byte
+	err := s.store.Iterate(start, limit, func(key, value []byte) bool {
+		if len(key) == archiveKeySize {
+			keys = append(keys, common.CopyBytes(key))
+		}
+		return max == 0 || len(keys) < max
+	})
+	return keys, err
+}
+
+// inventoryStart returns the first key of an inventory from the time from,
+// or right after the cursor of a previous one.
+func inventoryStart(from uint32, cursor []byte) []byte {
+	if len(cursor) > 0 {
+		return append(common.CopyBytes(cursor), 0)
+	}
+	return archiveKey(from, common.Hash{})
+}
+
+// archiveRangeLimit returns the limit of an iteration up to and including
+// the time to.
+func archiveRangeLimit(to uint32) []byte {
+	if to == ^uint32(0) {
+		return nil
+	}
+	return archiveKey(to+1, common.Hash{})
+}
+
+// get returns the RLP encoded envelope archived under key, or nil.
+func (s *mailServer) get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.store == nil {
+		return nil, errors.New("mail server is closed")
+	}
+	if len(key) != archiveKeySize {
+		return nil, nil
+	}
+	return lookup(s.store, key)
+}
+
+// put archives an RLP encoded envelope under key.
+func (s *mailServer) put(key, raw []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.store == nil {
+		return errors.New("mail server is closed")
+	}
+	return s.store.Put(key, raw)
+}
+
+// SyncArchive copies the envelopes archived between from and to (0
+// meaning no upper limit, as in RequestHistory) by the archive node whose
+// ArchiveAPI is at url, and missing from the node's own archive. It
+// compares the inventories of both archives page by page, and returns the
+// number of envelopes copied. The calls are signed with the node's key,
+// which the other node must allow.
+func (n *Node) SyncArchive(ctx context.Context, url string, from, to uint32) (int, error) {
+	if !n.running() {
+		return 0, ErrNotStarted
+	}
+	if to == 0 {
+		to = ^uint32(0)
+	}
+	if !n.config.MailServerMode {
+		return 0, &ConfigError{"MailServerMode", errors.New("only archive nodes can sync")}
+	}
+	client, err := rpc.DialContext(ctx, url)
+	if err != nil {
+		return 0, &NetworkError{"sync", err}
+	}
+	defer client.Close()
+
+	copied := 0
+	args := InventoryArgs{From: from, To: to}
+	for {
+		args.Time = uint32(time.Now().Unix())
+		if args.Nonce, err = archiveCallNonce(); err != nil {
+			return copied, &KeyError{"nonce", err}
+		}
+		if args.Signature, err = n.signArchiveCall(args.hash); err != nil {
+			return copied, &KeyError{"sign", err}
+		}
+		var inv Inventory
+		if err := client.CallContext(ctx, &inv, archiveNamespace+"_inventory", args); err != nil {
+			return copied, &NetworkError{"sync", err}
+		}
+		// the local keys of the range the page covers
+		limit := archiveRangeLimit(to)
+		if len(inv.Cursor) > 0 {
+			limit = append(common.CopyBytes(inv.Cursor), 0)
+		}
+		local, err := n.mailServer.inventory(inventoryStart(from, args.Cursor), limit, 0)
+		if err != nil {
+			return copied, &MailServerError{"sync", err}
+		}
+		c, err := n.fetchMissing(ctx, client, inv.Keys, local)
+		copied += c
+		if err != nil || len(inv.Cursor) == 0 {
+			return copied, err
+		}
+		args.Cursor = inv.Cursor
+	}
+}
+
+// fetchMissing copies the envelopes of the remote keys that are not among
+// the local keys.
+func (n *Node) fetchMissing(ctx context.Context, client *rpc.Client, remote []hexutil.Bytes, local [][]byte) (int, error) {
+	have := make(map[string]bool, len(local))
+	for _, k := range local {
+		have[string(k)] = true
+	}
+	var missing []hexutil.Bytes
+	for _, k := range remote {
+		if !have[string(k)] {
+			missing = append(missing, k)
+		}
+	}
+
+	copied := 0
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > syncBatch {
+			batch = batch[:syncBatch]
+		}
+		missing = missing[len(batch):]
+
+		requested := make(map[string]bool, len(batch))
+		for _, k := range batch {
+			requested[string(k)] = true
+		}
+		var envs []hexutil.Bytes
+		args := EnvelopesArgs{Time: uint32(time.Now().Unix()), Keys: batch}
+		nonce, err := archiveCallNonce()
+		if err != nil {
+			return copied, &KeyError{"nonce", err}
+		}
+		args.Nonce = nonce
+		if args.Signature, err = n.signArchiveCall(args.hash); err != nil {
+			return copied, &KeyError{"sign", err}
+		}
+		if err := client.CallContext(ctx, &envs, archiveNamespace+"_envelopes", args); err != nil {
+			return copied, &NetworkError{"sync", err}
+		}
+		for _, raw := range envs {
+			key, err := envelopeKey(raw)
+			if err == nil && !requested[string(key)] {
+				err = errors.New("envelope was not requested")
+			}
+			if err == nil {
+				err = n.mailServer.put(key, raw)
+			}
+			if err != nil {
+				n.log.Warn("invalid envelope from archive", "err", err)
+				continue
+			}
+			copied++
+		}
+	}
+	return copied, nil
+}
+
+// envelopeKey returns the archive key of an RLP encoded envelope.
+func envelopeKey(raw []byte) ([]byte, error) {
+	var env whisper.Envelope
+	if err := rlp.DecodeBytes(raw, &env); err != nil {
+		return nil, err
+	}
+	return archiveKey(env.Expiry-env.TTL, env.Hash()), nil
+}
+
+// syncLoop copies missing envelopes from the archive nodes of
+// Config.ArgSyncPeers right away and then every Config.ArgSyncTime seconds,
+// until the node stops. It covers the last ArgSyncAge seconds, but nothing
+// the retention of the node would prune again.
+func (n *Node) syncLoop() {
+	ticker := time.NewTicker(time.Duration(n.config.ArgSyncTime) * time.Second)
+	defer ticker.Stop()
+	for {
+		age := time.Duration(n.config.ArgSyncAge) * time.Second
+		if r := n.config.retention(); r.maxAge > 0 && r.maxAge < age {
+			age = r.maxAge
+		}
+		now := time.Now()
+		from, to := uint32(now.Add(-age).Unix()), uint32(now.Unix())
+
+		for _, url := range splitList(n.config.ArgSyncPeers) {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				select {
+				case <-n.done:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			copied, err := n.SyncArchive(ctx, url, from, to)
+			cancel()
+			if err != nil {
+				n.log.Warn("failed to sync archive", "peer", url, "copied", copied, "err", err)
+			} else if copied > 0 {
+				n.log.Info("synced archive", "peer", url, "copied", copied)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package wnode
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// startArchiveNode starts a standalone mail server with an archive in
+// memory. If keys are given, it serves the ArchiveAPI to them.
+func startArchiveNode(t *testing.T, keys ...*ecdsa.PublicKey) *Node {
+	c := testConfig()
+	c.BootstrapMode = true
+	c.ArgIP = "127.0.0.1:0"
+	c.MailServerMode = true
+	c.ArgDBType = StoreMemory
+	if len(keys) > 0 {
+		c.ArgArchiveAddr = "127.0.0.1:0"
+		c.ArgMailAllow = writeAllowList(t, keys)
+	}
+	n := NewNode(c)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start the archive node: %v", err)
+	}
+	return n
+}
+
+// writeAllowList writes keys to a temporary file for Config.ArgMailAllow.
+func writeAllowList(t *testing.T, keys []*ecdsa.PublicKey) string {
+	f, err := ioutil.TempFile("", "wnode-allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, k := range keys {
+		fmt.Fprintln(f, common.ToHex(crypto.FromECDSAPub(k)))
+	}
+	return f.Name()
+}
+
+// archiveTestEnvelope stores an envelope in the archive of n and returns
+// its archive key.
+func archiveTestEnvelope(t *testing.T, n *Node) []byte {
+	now := uint32(time.Now().Unix())
+	raw, err := rlp.EncodeToBytes(&whisper.Envelope{Expiry: now + 100, TTL: 100, Data: []byte("archived")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := envelopeKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.mailServer.put(key, raw); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSyncArchive(t *testing.T) {
+	dst := startArchiveNode(t)
+	defer dst.Stop()
+	src := startArchiveNode(t, dst.PublicKey())
+	defer src.Stop()
+	defer os.Remove(src.config.ArgMailAllow)
+
+	// to 0 is no upper limit, as in RequestHistory
+	key := archiveTestEnvelope(t, src)
+	copied, err := dst.SyncArchive(context.Background(), src.ArchiveURL(), 0, 0)
+	if err != nil || copied != 1 {
+		t.Fatalf("copied %d envelopes: %v", copied, err)
+	}
+	if raw, err := dst.mailServer.get(key); err != nil || raw == nil {
+		t.Errorf("envelope not copied: %v", err)
+	}
+}
+
+func TestSyncArchiveNotAllowed(t *testing.T) {
+	other, _ := crypto.GenerateKey()
+	src := startArchiveNode(t, &other.PublicKey)
+	defer src.Stop()
+	defer os.Remove(src.config.ArgMailAllow)
+	dst := startArchiveNode(t)
+	defer dst.Stop()
+
+	archiveTestEnvelope(t, src)
+	_, err := dst.SyncArchive(context.Background(), src.ArchiveURL(), 0, ^uint32(0))
+	if err == nil || !strings.Contains(err.Error(), errNotAllowed.Error()) {
+		t.Errorf("got %v, want %v", err, errNotAllowed)
+	}
+}
+
+func TestArchiveCalls(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	src := startArchiveNode(t, &key.PublicKey)
+	defer src.Stop()
+	defer os.Remove(src.config.ArgMailAllow)
+	client, err := rpc.Dial(src.ArchiveURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sign := func(args *InventoryArgs) {
+		args.Nonce, _ = archiveCallNonce()
+		hash, _ := args.hash()
+		args.Signature, _ = crypto.Sign(hash, key)
+	}
+
+	var inv Inventory
+	args := InventoryArgs{Time: uint32(time.Now().Unix()), To: ^uint32(0)}
+	if err := client.Call(&inv, "archive_inventory", args); err == nil {
+		t.Error("unsigned call served")
+	}
+	sign(&args)
+	if err := client.Call(&inv, "archive_inventory", args); err != nil {
+		t.Errorf("signed call refused: %v", err)
+	}
+	if err := client.Call(&inv, "archive_inventory", args); err == nil || !strings.Contains(err.Error(), errCallReplayed.Error()) {
+		t.Errorf("replayed call: got %v, want %v", err, errCallReplayed)
+	}
+	sign(&args)
+	if err := client.Call(&inv, "archive_inventory", args); err != nil {
+		t.Errorf("call with a new nonce refused: %v", err)
+	}
+	args.From = 1
+	if err := client.Call(&inv, "archive_inventory", args); err == nil {
+		t.Error("call served with the signature of other parameters")
+	}
+	args.Time -= uint32(2 * archiveCallWindow / time.Second)
+	sign(&args)
+	if err := client.Call(&inv, "archive_inventory", args); err == nil {
+		t.Error("old call served")
+	}
+
+	// the PublicAPI is not served next to the ArchiveAPI
+	var id string
+	if err := client.Call(&id, "wnode_newSymKey"); err == nil {
+		t.Error("PublicAPI served at the archive address")
+	}
+}
+
+func TestArchiveCallsExpire(t *testing.T) {
+	api := newArchiveAPI(nil)
+	now := time.Unix(1000, 0)
+	if !api.firstCall([]byte{1}, now.Add(archiveCallWindow), now) {
+		t.Error("first call refused")
+	}
+	if api.firstCall([]byte{1}, now.Add(archiveCallWindow), now.Add(archiveCallWindow)) {
+		t.Error("call served twice")
+	}
+	if !api.firstCall([]byte{2}, now.Add(3*archiveCallWindow), now.Add(2*archiveCallWindow)) || len(api.seen) != 1 {
+		t.Errorf("expired calls not forgotten: %d remembered", len(api.seen))
+	}
+}
+
+func TestArchiveVirtualHosts(t *testing.T) {
+	tests := []struct {
+		addr, hosts string
+		want        []string
+	}{
+		{"0.0.0.0:8547", "", []string{"localhost"}},
+		{"archive.example.org:8547", "", []string{"localhost", "archive.example.org"}},
+		{":8547", "a.example.org, b.example.org", []string{"localhost", "a.example.org", "b.example.org"}},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.ArgArchiveAddr, c.ArgArchiveHosts = test.addr, test.hosts
+		if got := archiveVirtualHosts(c); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s and %q: got %v, want %v", test.addr, test.hosts, got, test.want)
+		}
+	}
+}
+
+func TestArchiveCallsHost(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	src := startArchiveNode(t, &key.PublicKey)
+	defer src.Stop()
+	defer os.Remove(src.config.ArgMailAllow)
+
+	for host, want := range map[string]int{"localhost": http.StatusOK, "evil.example.org": http.StatusForbidden} {
+		req, _ := http.NewRequest("POST", src.ArchiveURL(), strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"rpc_modules"}`))
+		req.Host = host
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("host %s: got status %d, want %d", host, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package wnode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// pruneBatchSize is the number of deletions written to the database at once.
+const pruneBatchSize = 1024
+
+// retention limits what a mail server keeps in its database. Zero values
+// mean no limit.
+type retention struct {
+	maxAge      time.Duration
+	maxSize     int64 // bytes of keys and values
+	maxPerTopic int
+}
+
+func (c *Config) retention() retention {
+	return retention{
+		maxAge:      time.Duration(c.ArgRetainAge) * time.Second,
+		maxSize:     int64(c.ArgRetainSize) << 20,
+		maxPerTopic: int(c.ArgRetainTopic),
+	}
+}
+
+func (r retention) limited() bool {
+	return r.maxAge > 0 || r.maxSize > 0 || r.maxPerTopic > 0
+}
+
+// PruneStats reports the outcome of pruning a mail server database.
+type PruneStats struct {
+	Envelopes int   // envelopes found
+	Size      int64 // bytes found
+	Removed   int   // envelopes removed
+	Freed     int64 // bytes removed
+}
+
+func (s *PruneStats) String() string {
+	return fmt.Sprintf("removed %d of %d envelopes, %d of %d bytes", s.Removed, s.Envelopes, s.Freed, s.Size)
+}
+
+// archivedTopic returns the topic of an archived envelope.
+func archivedTopic(raw []byte) (whisper.TopicType, error) {
+	var env whisper.Envelope
+	if err := rlp.DecodeBytes(raw, &env); err != nil {
+		return whisper.TopicType{}, err
+	}
+	return env.Topic, nil
+}
+
+// pruneArchive removes the envelopes older than the retention age, then
+// the oldest envelopes of every topic above the per-topic limit and the
+// oldest envelopes overall until the store is within the size limit.
+// Envelopes on the way that can not be decoded are removed as well, the
+// mail server could not deliver them anyway. The freed range is compacted.
+func pruneArchive(store Store, r retention, now time.Time) (*PruneStats, error) {
+	var cutoff []byte
+	if r.maxAge > 0 {
+		cutoff = archiveKey(uint32(now.Add(-r.maxAge).Unix()), common.Hash{})
+	}
+	expired := func(key []byte) bool {
+		return cutoff != nil && bytes.Compare(key, cutoff) < 0
+	}
+
+	// first pass: what is left after removing the expired envelopes
+	stats := new(PruneStats)
+	topics := make(map[whisper.TopicType]int)
+	var size int64
+	err := store.Iterate(nil, nil, func(key, value []byte) bool {
+		n := int64(len(key) + len(value))
+		stats.Envelopes++
+		stats.Size += n
+		if !expired(key) {
+			if topic, err := archivedTopic(value); err == nil {
+				topics[topic]++
+				size += n
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return stats, err
+	}
+	over := 0 // topics above the per-topic limit
+	if r.maxPerTopic > 0 {
+		for _, count := range topics {
+			if count > r.maxPerTopic {
+				over++
+			}
+		}
+	}
+
+	// second pass: remove the oldest envelopes until all limits are met,
+	// in batches deleted between iterations, as stores may not be modified
+	// while they are iterated
+	var start, last []byte
+	for {
+		var batch [][]byte
+		err := store.Iterate(start, nil, func(key, value []byte) bool {
+			n := int64(len(key) + len(value))
+			if !expired(key) {
+				if over == 0 && (r.maxSize == 0 || size <= r.maxSize) {
+					return false
+				}
+				topic, err := archivedTopic(value)
+				if err == nil {
+					count := topics[topic]
+					if (r.maxPerTopic == 0 || count <= r.maxPerTopic) && (r.maxSize == 0 || size <= r.maxSize) {
+						return true
+					}
+					if r.maxPerTopic > 0 && count == r.maxPerTopic+1 {
+						over--
+					}
+					topics[topic]--
+					size -= n
+				}
+			}
+			batch = append(batch, common.CopyBytes(key))
+			stats.Removed++
+			stats.Freed += n
+			return len(batch) < pruneBatchSize
+		})
+		if err != nil {
+			return stats, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if err := store.Delete(batch...); err != nil {
+			return stats, err
+		}
+		last = batch[len(batch)-1]
+		start = append(common.CopyBytes(last), 0)
+		if len(batch) < pruneBatchSize {
+			break
+		}
+	}
+	if last != nil {
+		return stats, store.Compact(nil, start)
+	}
+	return stats, nil
+}
+
+// prune applies the retention of the mail server to its store.
+func (s *mailServer) prune(now time.Time) (*PruneStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.store == nil {
+		return nil, errors.New("mail server is closed")
+	}
+	return pruneArchive(s.store, s.retention, now)
+}
+
+// pruneLoop prunes the mail server database right away and then every
+// Config.ArgPruneTime seconds, until the node stops.
+func (n *Node) pruneLoop() {
+	ticker := time.NewTicker(time.Duration(n.config.ArgPruneTime) * time.Second)
+	defer ticker.Stop()
+	for {
+		stats, err := n.mailServer.prune(time.Now())
+		if err != nil {
+			n.log.Error("failed to prune the mail server database", "err", err)
+		} else if stats.Removed > 0 {
+			n.log.Info("pruned the mail server database", "removed", stats.Removed, "freed", stats.Freed)
+		}
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// CompactArchive prunes the mail server store of cfg.ArgDBType at
+// cfg.ArgDBPath by the retention of cfg and compacts it. The database must not be in use by a
+// running mail server.
+func CompactArchive(cfg *Config) (*PruneStats, error) {
+	c := *cfg
+	c.CompactMode = true
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	store, err := openArchive(&c)
+	if err != nil {
+		return nil, &MailServerError{"open", err}
+	}
+	defer store.Close()
+
+	stats, err := pruneArchive(store, c.retention(), time.Now())
+	if err != nil {
+		return stats, &MailServerError{"prune", err}
+	}
+	if err := store.Compact(nil, nil); err != nil {
+		return stats, &MailServerError{"compact", err}
+	}
+	return stats, nil
+}
+
+// compactArchive runs CompactArchive for the console and prints the result.
+func compactArchive(cfg *Config) error {
+	stats, err := CompactArchive(cfg)
+	if err != nil {
+		return err
+	}
+	newLogger(cfg).Info("mail server database compacted", "path", cfg.ArgDBPath, "envelopes", stats.Envelopes, "removed", stats.Removed, "freed", stats.Freed)
+	fmt.Printf("Mail server database compacted: %s \n", stats)
+	return nil
+}
@@ -0,0 +1,101 @@
+package wnode
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// archivedTimes returns the send times of the envelopes in s, oldest first.
+func archivedTimes(t *testing.T, s Store) []uint32 {
+	var times []uint32
+	err := s.Iterate(nil, nil, func(key, value []byte) bool {
+		times = append(times, binary.BigEndian.Uint32(key))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return times
+}
+
+// entrySize is the size pruneArchive counts for an envelope archived by
+// newTestMailServer.
+func entrySize(t *testing.T, s Store) int64 {
+	var size int64
+	s.Iterate(nil, nil, func(key, value []byte) bool {
+		size = int64(len(key) + len(value))
+		return false
+	})
+	return size
+}
+
+func TestPruneArchive(t *testing.T) {
+	sent := []uint32{10, 11, 12, 13, 14, 15}
+	one := newTestMailServer(t, 10)
+	size := entrySize(t, one.store)
+	one.store.Close()
+	now := time.Unix(100, 0)
+
+	tests := []struct {
+		name      string
+		retention retention
+		want      []uint32
+	}{
+		{"unlimited", retention{}, sent},
+		{"age", retention{maxAge: 87 * time.Second}, []uint32{13, 14, 15}},
+		{"per topic", retention{maxPerTopic: 1}, []uint32{14, 15}},
+		{"size", retention{maxSize: 2*size + 1}, []uint32{14, 15}},
+		{"age and per topic", retention{maxAge: 88 * time.Second, maxPerTopic: 2}, []uint32{12, 13, 14, 15}},
+	}
+	for _, test := range tests {
+		s := newTestMailServer(t, sent...)
+		stats, err := pruneArchive(s.store, test.retention, now)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if got := archivedTimes(t, s.store); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: kept %v, want %v", test.name, got, test.want)
+		} else if removed := len(sent) - len(test.want); stats.Removed != removed || stats.Freed != int64(removed)*size || stats.Envelopes != len(sent) {
+			t.Errorf("%s: stats %s, want %d of %d removed", test.name, stats, removed, len(sent))
+		}
+		s.store.Close()
+	}
+}
+
+func TestPruneArchiveUndecodable(t *testing.T) {
+	s := newTestMailServer(t, 10, 11, 12)
+	defer s.store.Close()
+	if err := s.store.Put(archiveKey(5, common.Hash{}), []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the garbage is on the way to the oldest envelope of topic a
+	if _, err := pruneArchive(s.store, retention{maxPerTopic: 1}, time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := archivedTimes(t, s.store), []uint32{11, 12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
+
+func TestPruneArchiveBatches(t *testing.T) {
+	sent := make([]uint32, 3*pruneBatchSize)
+	for i := range sent {
+		sent[i] = uint32(1000 + i)
+	}
+	s := newTestMailServer(t, sent...)
+	defer s.store.Close()
+
+	keep := 100
+	cutoff := time.Unix(int64(sent[len(sent)-keep]), 0)
+	stats, err := pruneArchive(s.store, retention{maxAge: time.Second}, cutoff.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != len(sent)-keep || len(archivedTimes(t, s.store)) != keep {
+		t.Errorf("%s, %d kept; want %d kept", stats, len(archivedTimes(t, s.store)), keep)
+	}
+}
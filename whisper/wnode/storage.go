@@ -0,0 +1,232 @@
+package wnode
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Storage backends of an archive node, selected by Config.ArgDBType.
+const (
+	StoreLevelDB = "leveldb" // LevelDB directory at ArgDBPath, the layout of mailserver.WMailServer
+	StoreBolt    = "bolt"    // single Bolt file at ArgDBPath
+	StoreMemory  = "memory"  // in memory, lost when the node stops
+)
+
+// Store holds the envelopes of an archive node under their archive keys.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Put stores value under key.
+	Put(key, value []byte) error
+	// Delete removes the given keys.
+	Delete(keys ...[]byte) error
+	// Iterate calls fn with the entries from start up to, not including,
+	// limit in key order, until fn returns false. A nil start or limit
+	// leaves the range open on that side. The key and value are only valid
+	// during the call; fn must not modify the store.
+	Iterate(start, limit []byte, fn func(key, value []byte) bool) error
+	// Compact reclaims the space of the entries deleted between start and
+	// limit, if the store needs it.
+	Compact(start, limit []byte) error
+	Close() error
+}
+
+// OpenStore opens the store of the given kind at path. An empty kind
+// selects StoreLevelDB.
+func OpenStore(kind, path string) (Store, error) {
+	switch kind {
+	case "", StoreLevelDB:
+		db, err := leveldb.OpenFile(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &levelStore{db}, nil
+	case StoreBolt:
+		return openBoltStore(path)
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", kind)
+	}
+}
+
+type levelStore struct {
+	db *leveldb.DB
+}
+
+func (s *levelStore) Put(key, value []byte) error {
+	return s.db.Put(key, value, nil)
+}
+
+func (s *levelStore) Delete(keys ...[]byte) error {
+	batch := new(leveldb.Batch)
+	for _, key := range keys {
+		batch.Delete(key)
+	}
+	return s.db.Write(batch, nil)
+}
+
+func (s *levelStore) Iterate(start, limit []byte, fn func(key, value []byte) bool) error {
+	it := s.db.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	defer it.Release()
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Error()
+}
+
+func (s *levelStore) Compact(start, limit []byte) error {
+	return s.db.CompactRange(util.Range{Start: start, Limit: limit})
+}
+
+func (s *levelStore) Close() error {
+	return s.db.Close()
+}
+
+// boltBucket is the bucket of the envelopes in a Bolt file.
+var boltBucket = []byte("envelopes")
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	// the timeout turns a file locked by another node into an error
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+func (s *boltStore) Put(key, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (s *boltStore) Delete(keys ...[]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		for _, key := range keys {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Iterate(start, limit []byte, fn func(key, value []byte) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		k, v := c.First()
+		if start != nil {
+			k, v = c.Seek(start)
+		}
+		for ; k != nil && (limit == nil || bytes.Compare(k, limit) < 0); k, v = c.Next() {
+			if !fn(k, v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Compact does nothing, Bolt reuses the pages of deleted entries.
+func (s *boltStore) Compact(start, limit []byte) error {
+	return nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// memoryStore keeps the entries in a sorted slice.
+type memoryStore struct {
+	mu      sync.RWMutex
+	entries []memoryEntry
+}
+
+type memoryEntry struct {
+	key, value []byte
+}
+
+// NewMemoryStore returns an empty store that lives in memory only, for
+// tests and ephemeral archive nodes.
+func NewMemoryStore() Store {
+	return new(memoryStore)
+}
+
+// search returns the index of the first entry not below key.
+func (s *memoryStore) search(key []byte) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return bytes.Compare(s.entries[i].key, key) >= 0
+	})
+}
+
+func (s *memoryStore) Put(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := memoryEntry{append([]byte(nil), key...), append([]byte(nil), value...)}
+	i := s.search(key)
+	if i < len(s.entries) && bytes.Equal(s.entries[i].key, key) {
+		s.entries[i] = e
+		return nil
+	}
+	s.entries = append(s.entries, memoryEntry{})
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = e
+	return nil
+}
+
+func (s *memoryStore) Delete(keys ...[]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		i := s.search(key)
+		if i < len(s.entries) && bytes.Equal(s.entries[i].key, key) {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Iterate(start, limit []byte, fn func(key, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := s.search(start); i < len(s.entries); i++ {
+		e := s.entries[i]
+		if limit != nil && bytes.Compare(e.key, limit) >= 0 || !fn(e.key, e.value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Compact(start, limit []byte) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,189 @@
+package wnode
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestStores opens a store of every kind in dir.
+func openTestStores(t *testing.T, dir string) map[string]Store {
+	stores := make(map[string]Store)
+	for _, kind := range []string{StoreMemory, StoreLevelDB, StoreBolt} {
+		s, err := OpenStore(kind, filepath.Join(dir, kind))
+		if err != nil {
+			t.Fatalf("failed to open the %s store: %v", kind, err)
+		}
+		stores[kind] = s
+	}
+	return stores
+}
+
+// storeContents returns the entries of s between start and limit as
+// key=value strings, in the order of iteration.
+func storeContents(t *testing.T, s Store, start, limit []byte) []string {
+	var entries []string
+	err := s.Iterate(start, limit, func(key, value []byte) bool {
+		entries = append(entries, fmt.Sprintf("%s=%s", key, value))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("iterate failed: %v", err)
+	}
+	return entries
+}
+
+func TestStores(t *testing.T) {
+	tests := []struct {
+		name         string
+		put          []string // keys, stored with their value "v" + key
+		overwrite    string   // key stored again with the value "new"
+		delete       []string
+		start, limit string // empty for an open range
+		want         []string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "key order",
+			put:  []string{"c", "a", "b"},
+			want: []string{"a=va", "b=vb", "c=vc"},
+		},
+		{
+			name:      "overwrite",
+			put:       []string{"a", "b"},
+			overwrite: "a",
+			want:      []string{"a=new", "b=vb"},
+		},
+		{
+			name:   "delete",
+			put:    []string{"a", "b", "c"},
+			delete: []string{"b", "missing"},
+			want:   []string{"a=va", "c=vc"},
+		},
+		{
+			name:  "range",
+			put:   []string{"a", "b", "c", "d"},
+			start: "b",
+			limit: "d",
+			want:  []string{"b=vb", "c=vc"},
+		},
+		{
+			name:  "start between keys",
+			put:   []string{"a", "c"},
+			start: "b",
+			want:  []string{"c=vc"},
+		},
+		{
+			name:  "limit only",
+			put:   []string{"a", "b", "c"},
+			limit: "b",
+			want:  []string{"a=va"},
+		},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "wnode-store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for kind, s := range openTestStores(t, dir) {
+			for _, key := range test.put {
+				if err := s.Put([]byte(key), []byte("v"+key)); err != nil {
+					t.Fatalf("%s/%s: put failed: %v", test.name, kind, err)
+				}
+			}
+			if len(test.overwrite) > 0 {
+				if err := s.Put([]byte(test.overwrite), []byte("new")); err != nil {
+					t.Fatalf("%s/%s: put failed: %v", test.name, kind, err)
+				}
+			}
+			var keys [][]byte
+			for _, key := range test.delete {
+				keys = append(keys, []byte(key))
+			}
+			if err := s.Delete(keys...); err != nil {
+				t.Fatalf("%s/%s: delete failed: %v", test.name, kind, err)
+			}
+			var start, limit []byte
+			if len(test.start) > 0 {
+				start = []byte(test.start)
+			}
+			if len(test.limit) > 0 {
+				limit = []byte(test.limit)
+			}
+			got := storeContents(t, s, start, limit)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("%s/%s: got %v, want %v", test.name, kind, got, test.want)
+			}
+			for _, key := range test.put {
+				value, err := lookup(s, []byte(key))
+				if err != nil {
+					t.Fatalf("%s/%s: get failed: %v", test.name, kind, err)
+				}
+				deleted := false
+				for _, d := range test.delete {
+					deleted = deleted || d == key
+				}
+				if deleted && value != nil || !deleted && value == nil {
+					t.Errorf("%s/%s: got %q for %s", test.name, kind, value, key)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("%s/%s: close failed: %v", test.name, kind, err)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStoreStopsIteration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for kind, s := range openTestStores(t, dir) {
+		for _, key := range []string{"a", "b", "c"} {
+			s.Put([]byte(key), []byte(key))
+		}
+		calls := 0
+		s.Iterate(nil, nil, func(key, value []byte) bool {
+			calls++
+			return !bytes.Equal(key, []byte("b"))
+		})
+		if calls != 2 {
+			t.Errorf("%s: %d calls, want 2", kind, calls)
+		}
+		s.Close()
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, kind := range []string{StoreLevelDB, StoreBolt} {
+		path := filepath.Join(dir, kind)
+		s, err := OpenStore(kind, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put([]byte("key"), []byte("value"))
+		s.Close()
+		if s, err = OpenStore(kind, path); err != nil {
+			t.Fatal(err)
+		}
+		if got := storeContents(t, s, nil, nil); fmt.Sprint(got) != "[key=value]" {
+			t.Errorf("%s: reopened store holds %v", kind, got)
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package wnode
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Payload encodings of streamed messages.
+const (
+	EncodingText   = "text"
+	EncodingBase64 = "base64"
+)
+
+// StreamArgs select the messages of a stream.
+type StreamArgs struct {
+	Subscriptions []string `json:"subscriptions"` // names of the subscriptions to stream, all if empty
+	Encoding      string   `json:"encoding"`      // payload encoding, EncodingBase64 if empty
+}
+
+// StreamMessage is a received message as sent to stream clients.
+type StreamMessage struct {
+	Hash         common.Hash       `json:"hash"`
+	Subscription string            `json:"subscription"`
+	Topic        whisper.TopicType `json:"topic"`
+	Sender       *common.Address   `json:"sender,omitempty"`
+	Sent         uint64            `json:"sent"`
+	Payload      string            `json:"payload"`
+	Encoding     string            `json:"encoding"` // encoding of Payload
+}
+
+// newStreamMessage converts m, encoding the payload as requested. A payload
+// that is not valid UTF-8 is always encoded in base64.
+func newStreamMessage(m *Message, encoding string) *StreamMessage {
+	msg := &StreamMessage{
+		Hash:         m.Hash,
+		Subscription: m.Subscription,
+		Topic:        m.Topic,
+		Sent:         uint64(m.Sent.Unix()),
+	}
+	if m.SenderKey != nil {
+		sender := m.Sender
+		msg.Sender = &sender
+	}
+	if encoding == EncodingText && utf8.Valid(m.Payload) {
+		msg.Payload, msg.Encoding = string(m.Payload), EncodingText
+	} else {
+		msg.Payload, msg.Encoding = base64.StdEncoding.EncodeToString(m.Payload), EncodingBase64
+	}
+	return msg
+}
+
+// Messages streams received messages to the client as notifications. It is
+// only available over WebSocket, as wnode_subscribe("messages", args).
+func (api *PublicAPI) Messages(ctx context.Context, args StreamArgs) (*rpc.Subscription, error) {
+	switch args.Encoding {
+	case "":
+		args.Encoding = EncodingBase64
+	case EncodingText, EncodingBase64:
+	default:
+		return nil, &ConfigError{"encoding", fmt.Errorf("unknown encoding %q", args.Encoding)}
+	}
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range args.Subscriptions {
+		selected[name] = true
+	}
+
+	// the watcher runs on the message loop and must not block;
+	// messages a slow client does not take in time are skipped
+	messages := make(chan *Message, api.n.config.ArgBufferSize)
+	unwatch := api.n.watch(func(m *Message) {
+		if len(selected) > 0 && !selected[m.Subscription] {
+			return
+		}
+		select {
+		case messages <- m:
+		default:
+			api.n.log.Debug("stream client falls behind, message skipped", "hash", m.Hash.Hex())
+		}
+	})
+
+	sub := notifier.CreateSubscription()
+	go func() {
+		defer unwatch()
+		for {
+			select {
+			case m := <-messages:
+				if err := notifier.Notify(sub.ID, newStreamMessage(m, args.Encoding)); err != nil {
+					return
+				}
+			case <-sub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			case <-api.n.done:
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,102 @@
+package wnode
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// streamMessages subscribes to the messages of n over WebSocket.
+func streamMessages(t *testing.T, client *rpc.Client, args StreamArgs) (chan *StreamMessage, *rpc.ClientSubscription) {
+	ch := make(chan *StreamMessage, 16)
+	sub, err := client.Subscribe(context.Background(), rpcNamespace, ch, "messages", args)
+	if err != nil {
+		t.Fatalf("subscribing with %+v: %v", args, err)
+	}
+	return ch, sub
+}
+
+// nextStreamMessage waits for a message of the stream.
+func nextStreamMessage(t *testing.T, ch chan *StreamMessage, sub *rpc.ClientSubscription) *StreamMessage {
+	select {
+	case m := <-ch:
+		return m
+	case err := <-sub.Err():
+		t.Fatalf("stream failed: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message streamed")
+	}
+	return nil
+}
+
+func TestStreamMessages(t *testing.T) {
+	c := testConfig()
+	c.ArgWSAddr = "127.0.0.1:0"
+	n := startTestNode(t, c)
+	defer n.Stop()
+	client, err := rpc.Dial(n.WSURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	topic := whisper.BytesToTopic([]byte("othr"))
+	if err := n.Subscribe("other", SubscriptionConfig{Topics: []whisper.TopicType{topic}, SymKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	text, textSub := streamMessages(t, client, StreamArgs{Subscriptions: []string{DefaultSymSubscription}, Encoding: EncodingText})
+	defer textSub.Unsubscribe()
+	other, otherSub := streamMessages(t, client, StreamArgs{Subscriptions: []string{"other"}})
+	defer otherSub.Unsubscribe()
+
+	hash, err := n.Send(context.Background(), []byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := nextStreamMessage(t, text, textSub)
+	sender := crypto.PubkeyToAddress(*n.PublicKey())
+	if m.Hash != hash || m.Subscription != DefaultSymSubscription || m.Topic != n.Topic() || m.Sender == nil || *m.Sender != sender || m.Sent == 0 {
+		t.Errorf("streamed %+v", m)
+	}
+	if m.Payload != "hello" || m.Encoding != EncodingText {
+		t.Errorf("text payload streamed as %q in %s", m.Payload, m.Encoding)
+	}
+
+	// a payload that is not UTF-8 is encoded in base64 anyway
+	if _, err := n.Send(context.Background(), []byte{0xff, 0}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m := nextStreamMessage(t, text, textSub); m.Payload != "/wA=" || m.Encoding != EncodingBase64 {
+		t.Errorf("binary payload streamed as %q in %s", m.Payload, m.Encoding)
+	}
+
+	// the stream of the other subscription got none of the above
+	if _, err := n.Send(context.Background(), []byte("other"), &SendOptions{Topic: &topic, SymKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	m = nextStreamMessage(t, other, otherSub)
+	if m.Subscription != "other" || m.Payload != base64.StdEncoding.EncodeToString([]byte("other")) || m.Encoding != EncodingBase64 {
+		t.Errorf("other subscription streamed %+v", m)
+	}
+	select {
+	case m := <-other:
+		t.Errorf("other subscription streamed %+v", m)
+	case m := <-text:
+		t.Errorf("symmetric subscription streamed %+v", m)
+	case <-time.After(2 * sweepInterval):
+	}
+
+	ch := make(chan *StreamMessage)
+	if _, err := client.Subscribe(context.Background(), rpcNamespace, ch, "messages", StreamArgs{Encoding: "hex"}); err == nil {
+		t.Error("subscribed with an unknown encoding")
+	}
+}
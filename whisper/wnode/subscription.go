@@ -0,0 +1,231 @@
+package wnode
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Names of the subscriptions a node installs for its own Config.
+const (
+	DefaultSymSubscription  = "sym"  // symmetric key derived from ArgSymPass
+	DefaultAsymSubscription = "asym" // the node's private key
+)
+
+// SubscriptionConfig describes which messages a subscription receives.
+// Exactly one of SymPass, SymKey and PrivateKey must be set.
+type SubscriptionConfig struct {
+	Topics     []whisper.TopicType // topics to listen to, at least one
+	SymPass    string              // password the symmetric key is derived from
+	SymKey     []byte              // symmetric key
+	PrivateKey *ecdsa.PrivateKey   // private key for asymmetric decryption
+	AllowP2P   bool                // accept peer-to-peer messages, e.g. from a mail server
+	MinPoW     float64             // minimum PoW of accepted envelopes
+}
+
+// subscription is a named whisper filter installed by the node.
+type subscription struct {
+	name     string
+	filter   *whisper.Filter
+	filterID string
+	keyID    string // whisper key owned by the subscription, deleted with it
+	sym      bool
+
+	// filters installed by RequestHistory deliver to the request only,
+	// in the name of the subscription they were derived from; the marker
+	// filter receives the page markers of the mail server
+	history *historyRequest
+	origin  string
+	marker  bool
+}
+
+// Subscribe installs a filter for the messages described by cfg. Messages
+// it receives carry its name in Message.Subscription. Subscriptions can be
+// added and removed while the node is running.
+func (n *Node) Subscribe(name string, cfg SubscriptionConfig) error {
+	if !n.running() {
+		return ErrNotStarted
+	}
+	if len(name) == 0 {
+		return &ConfigError{"name", errors.New("subscription name is empty")}
+	}
+	if len(cfg.Topics) == 0 {
+		return &ConfigError{"Topics", errors.New("at least one topic is required")}
+	}
+	keys := 0
+	for _, set := range []bool{len(cfg.SymPass) > 0, cfg.SymKey != nil, cfg.PrivateKey != nil} {
+		if set {
+			keys++
+		}
+	}
+	if keys != 1 {
+		return &KeyError{"subscription key", errors.New("exactly one of SymPass, SymKey and PrivateKey must be set")}
+	}
+
+	n.subsMu.Lock()
+	defer n.subsMu.Unlock()
+	if _, ok := n.subs[name]; ok {
+		return &ConfigError{"name", fmt.Errorf("subscription %q already exists", name)}
+	}
+
+	s := &subscription{name: name}
+	filter := &whisper.Filter{
+		Topics:   topicsToBytes(cfg.Topics),
+		AllowP2P: cfg.AllowP2P,
+		PoW:      cfg.MinPoW,
+	}
+
+	var err error
+	switch {
+	case len(cfg.SymPass) > 0:
+		if s.keyID, err = n.shh.AddSymKeyFromPassword(cfg.SymPass); err != nil {
+			return &KeyError{"symmetric key", err}
+		}
+		filter.KeySym, err = n.shh.GetSymKey(s.keyID)
+		s.sym = true
+	case cfg.SymKey != nil:
+		if s.keyID, err = n.shh.AddSymKeyDirect(cfg.SymKey); err != nil {
+			return &KeyError{"symmetric key", err}
+		}
+		filter.KeySym, err = n.shh.GetSymKey(s.keyID)
+		s.sym = true
+	default:
+		if s.keyID, err = n.shh.AddKeyPair(cfg.PrivateKey); err != nil {
+			return &KeyError{"private key", err}
+		}
+		filter.KeyAsym = cfg.PrivateKey
+	}
+	if err != nil {
+		n.deleteKey(s)
+		return &KeyError{"symmetric key", err}
+	}
+
+	return n.install(s, filter)
+}
+
+// Unsubscribe removes the named subscription and the keys it installed.
+// The filters of history requests are not subscriptions; they are removed
+// when their request completes.
+func (n *Node) Unsubscribe(name string) error {
+	if !n.running() {
+		return ErrNotStarted
+	}
+	n.subsMu.Lock()
+	defer n.subsMu.Unlock()
+
+	s, ok := n.subs[name]
+	if !ok {
+		return &ConfigError{"name", fmt.Errorf("no subscription %q", name)}
+	}
+	if s.history != nil {
+		return &ConfigError{"name", fmt.Errorf("%q is a filter of a history request", name)}
+	}
+	delete(n.subs, name)
+	n.deleteKey(s)
+	if err := n.shh.Unsubscribe(s.filterID); err != nil {
+		return &NetworkError{"uninstall filter", err}
+	}
+	n.log.Info("unsubscribed", "subscription", name)
+	return nil
+}
+
+// Subscriptions returns the names of the installed subscriptions.
+func (n *Node) Subscriptions() []string {
+	n.subsMu.RLock()
+	defer n.subsMu.RUnlock()
+
+	names := make([]string, 0, len(n.subs))
+	for name, s := range n.subs {
+		if s.history == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// subscriptions returns a snapshot of the installed subscriptions,
+// including the filters of history requests.
+func (n *Node) subscriptions() []*subscription {
+	n.subsMu.RLock()
+	defer n.subsMu.RUnlock()
+
+	subs := make([]*subscription, 0, len(n.subs))
+	for _, s := range n.subs {
+		subs = append(subs, s)
+	}
+	return subs
+}
+
+// subscribed reports whether a subscription of the node is for topic.
+func (n *Node) subscribed(topic whisper.TopicType) bool {
+	n.subsMu.RLock()
+	defer n.subsMu.RUnlock()
+
+	for _, s := range n.subs {
+		if matchTopics(topic, s.filter.Topics) {
+			return true
+		}
+	}
+	return false
+}
+
+// install subscribes the filter with whisper and registers it under s.name.
+// It must be called with subsMu held.
+func (n *Node) install(s *subscription, filter *whisper.Filter) error {
+	id, err := n.shh.Subscribe(filter)
+	if err != nil {
+		n.deleteKey(s)
+		return &NetworkError{"install filter", err}
+	}
+	s.filter, s.filterID = filter, id
+	n.subs[s.name] = s
+
+	logf := n.log.Info
+	if s.history != nil {
+		logf = n.log.Debug
+	}
+	logf("subscribed", "subscription", s.name, "topics", fmt.Sprintf("%x", filter.Topics), "p2p", filter.AllowP2P)
+	return nil
+}
+
+func (n *Node) deleteKey(s *subscription) {
+	if len(s.keyID) == 0 {
+		return
+	}
+	if s.sym {
+		n.shh.DeleteSymKey(s.keyID)
+	} else {
+		n.shh.DeleteKeyPair(s.keyID)
+	}
+}
+
+// parseTopics parses a comma separated list of hexadecimal topics.
+func parseTopics(s string) ([]whisper.TopicType, error) {
+	var topics []whisper.TopicType
+	for _, t := range strings.Split(s, ",") {
+		x, err := hex.DecodeString(strings.TrimSpace(t))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the topic: %s", err)
+		}
+		if len(x) > whisper.TopicLength {
+			return nil, fmt.Errorf("topic %s is longer than %d bytes", t, whisper.TopicLength)
+		}
+		topics = append(topics, whisper.BytesToTopic(x))
+	}
+	return topics, nil
+}
+
+func topicsToBytes(topics []whisper.TopicType) [][]byte {
+	b := make([][]byte, len(topics))
+	for i := range topics {
+		t := topics[i]
+		b[i] = t[:]
+	}
+	return b
+}
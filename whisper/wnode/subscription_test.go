@@ -0,0 +1,97 @@
+package wnode
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+func TestSubscribe(t *testing.T) {
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+
+	cfg := SubscriptionConfig{Topics: n.Topics(), SymPass: "extra"}
+	if err := n.Subscribe("extra", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n.Subscriptions(), []string{DefaultAsymSubscription, "extra", DefaultSymSubscription}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriptions: got %v, want %v", got, want)
+	}
+
+	var cfgErr *ConfigError
+	if err := n.Subscribe("extra", cfg); !errors.As(err, &cfgErr) || cfgErr.Field != "name" {
+		t.Errorf("duplicate name: got %v, want a ConfigError", err)
+	}
+	if err := n.Subscribe("", cfg); !errors.As(err, &cfgErr) || cfgErr.Field != "name" {
+		t.Errorf("empty name: got %v, want a ConfigError", err)
+	}
+	if err := n.Subscribe("notopics", SubscriptionConfig{SymPass: "extra"}); !errors.As(err, &cfgErr) || cfgErr.Field != "Topics" {
+		t.Errorf("no topics: got %v, want a ConfigError", err)
+	}
+
+	if err := n.Unsubscribe("extra"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Unsubscribe("extra"); !errors.As(err, &cfgErr) {
+		t.Errorf("second unsubscribe: got %v, want a ConfigError", err)
+	}
+	if got, want := n.Subscriptions(), []string{DefaultAsymSubscription, DefaultSymSubscription}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriptions after unsubscribe: got %v, want %v", got, want)
+	}
+	// the name is free again
+	if err := n.Subscribe("extra", cfg); err != nil {
+		t.Errorf("subscribe after unsubscribe: %v", err)
+	}
+}
+
+func TestSubscribeKeys(t *testing.T) {
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []SubscriptionConfig{
+		{},
+		{SymPass: "extra", SymKey: make([]byte, 32)},
+		{SymPass: "extra", PrivateKey: key},
+		{SymKey: make([]byte, 32), PrivateKey: key},
+	} {
+		cfg.Topics = n.Topics()
+		var keyErr *KeyError
+		if err := n.Subscribe("keys", cfg); !errors.As(err, &keyErr) {
+			t.Errorf("subscribe with keys %+v: got %v, want a KeyError", cfg, err)
+		}
+	}
+	if err := n.Subscribe("key", SubscriptionConfig{Topics: n.Topics(), PrivateKey: key}); err != nil {
+		t.Errorf("subscribe with a private key: %v", err)
+	}
+}
+
+func TestUnsubscribeHistory(t *testing.T) {
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+
+	r := newHistoryRequest(0, 0, log.Root())
+	if err := n.installHistory(r, n.SymKey(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer n.uninstallHistory(r)
+
+	name := fmt.Sprintf("history-%p", r)
+	var cfgErr *ConfigError
+	if err := n.Unsubscribe(name); !errors.As(err, &cfgErr) {
+		t.Errorf("unsubscribe of a history filter: got %v, want a ConfigError", err)
+	}
+	n.subsMu.RLock()
+	_, ok := n.subs[name]
+	n.subsMu.RUnlock()
+	if !ok {
+		t.Error("history filter was removed")
+	}
+}
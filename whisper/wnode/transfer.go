@@ -0,0 +1,596 @@
+package wnode
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Files are sent with a header carrying their name, MIME type, size and
+// checksum: as a single file frame if they fit into one envelope, else as a
+// manifest followed by numbered chunks. Receivers acknowledge the pieces
+// if the sender asks them to. Every frame is an ordinary message whose
+// payload is transferMagic, the frame kind and the RLP encoded frame.
+var transferMagic = []byte("wnft")
+
+const (
+	frameManifest byte = iota + 1
+	frameChunk
+	frameFile
+	frameAck
+)
+
+const (
+	// transferOverhead is the space reserved in an envelope for the framing
+	// of a chunk or file, the padding, the signature and the encryption.
+	transferOverhead = 1024
+
+	// maxNameLength limits the file names sent, to keep them within the
+	// transfer overhead.
+	maxNameLength = 255
+
+	// sidecarExt is appended to the name of a received file to name its
+	// FileInfo sidecar. Files named so are not accepted, so that a file
+	// and a sidecar never take each other's place.
+	sidecarExt = ".json"
+
+	// maxSaveAttempts bounds the names tried for a received file before it
+	// is given up as having no free name.
+	maxSaveAttempts = 100
+
+	// megabyte is the unit of the transfer limits of the config.
+	megabyte = 1 << 20
+
+	// chunkInterval paces the chunks of a file. Whisper sends a peer all
+	// new envelopes in one bundle every 300ms and disconnects peers whose
+	// bundles exceed the maximum message size, so chunks are no larger than
+	// half of it and go out at most one per bundle.
+	chunkInterval = 400 * time.Millisecond
+)
+
+type transferID [16]byte
+
+// fileHeader describes a file sent.
+type fileHeader struct {
+	Name   string
+	MIME   string
+	Size   uint64
+	SHA256 common.Hash
+}
+
+// file is a file sent in a single envelope.
+type file struct {
+	ID     transferID
+	Header fileHeader
+	Ack    bool // sender waits for an acknowledgement
+	Data   []byte
+}
+
+// manifest announces a chunked file.
+type manifest struct {
+	ID     transferID
+	Header fileHeader
+	Chunks uint32
+	Ack    bool // sender waits for acknowledgements
+}
+
+type chunk struct {
+	ID    transferID
+	Index uint32
+	Data  []byte
+}
+
+// FileInfo describes a received file. It is saved next to the file, in a
+// sidecar named after the file with a .json extension.
+type FileInfo struct {
+	Name     string            `json:"name"`             // name the sender gave the file
+	MIME     string            `json:"mime"`             // MIME type
+	Size     uint64            `json:"size"`             // size in bytes
+	SHA256   common.Hash       `json:"sha256"`           // SHA-256 checksum of the content
+	Sender   *common.Address   `json:"sender,omitempty"` // address of the signer, if the file was signed
+	Topic    whisper.TopicType `json:"topic"`            // topic the file was sent with
+	Envelope common.Hash       `json:"envelope"`         // hash of the envelope with the file or its manifest
+	Chunks   uint32            `json:"chunks,omitempty"` // number of chunks, if the file was chunked
+	Sent     time.Time         `json:"sent"`             // time the file or its manifest was sent
+	Received time.Time         `json:"received"`         // time the file was saved
+}
+
+func encodeFrame(kind byte, frame interface{}) ([]byte, error) {
+	body, err := rlp.EncodeToBytes(frame)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, 0, len(transferMagic)+1+len(body))
+	payload = append(payload, transferMagic...)
+	payload = append(payload, kind)
+	return append(payload, body...), nil
+}
+
+// decodeFrame splits a transfer payload into its kind and body. It reports
+// false for the payloads of ordinary messages.
+func decodeFrame(payload []byte) (kind byte, body []byte, ok bool) {
+	if len(payload) <= len(transferMagic) || !bytes.HasPrefix(payload, transferMagic) {
+		return 0, nil, false
+	}
+	return payload[len(transferMagic)], payload[len(transferMagic)+1:], true
+}
+
+// chunkSize is the largest piece of a file sent in a single envelope.
+func (n *Node) chunkSize() int {
+	return int(n.config.ArgMaxSize)/2 - transferOverhead
+}
+
+// SendFile sends the named file along with its name, MIME type, size and
+// checksum. A file that fits into a single envelope is sent as one message;
+// a larger file is split into chunks preceded by a manifest. The receiver
+// saves the file in its ArgSaveDir under its original name; it must accept
+// messages of the sender's ArgMaxSize.
+//
+// If ArgAckTime is set, SendFile waits until the receiver acknowledges the
+// file, retransmitting the pieces it is missing, and fails if the file is
+// not acknowledged within ArgAckTime seconds. Acknowledgements come back on
+// the topic and with the key the file was sent with, so they only reach the
+// sender if it subscribes to them. A file sent with a symmetric key is
+// acknowledged by the first node that signs an acknowledgement for it.
+//
+// SendFile returns the hash of the first envelope sent.
+func (n *Node) SendFile(ctx context.Context, path string, opts *SendOptions) (common.Hash, error) {
+	if !n.running() {
+		return common.Hash{}, ErrNotStarted
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	h := fileHeader{
+		Name:   filepath.Base(path),
+		MIME:   fileType(path, data),
+		Size:   uint64(len(data)),
+		SHA256: sha256.Sum256(data),
+	}
+	if len(h.Name) > maxNameLength {
+		return common.Hash{}, fmt.Errorf("file name is longer than %d bytes", maxNameLength)
+	}
+	if isSidecarName(h.Name) {
+		return common.Hash{}, fmt.Errorf("file name ends in %s, which is reserved for the metadata of received files", sidecarExt)
+	}
+	var id transferID
+	if _, err := crand.Read(id[:]); err != nil {
+		return common.Hash{}, fmt.Errorf("crypto/rand failed: %s", err)
+	}
+	ack := n.config.ArgAckTime > 0
+
+	// pieces[0] is the file or its manifest, pieces[i+1] is chunk i
+	var pieces [][]byte
+	size := n.chunkSize()
+	if len(data) <= size {
+		payload, err := encodeFrame(frameFile, &file{id, h, ack, data})
+		if err != nil {
+			return common.Hash{}, err
+		}
+		pieces = append(pieces, payload)
+	} else {
+		m := &manifest{
+			ID:     id,
+			Header: h,
+			Chunks: uint32((len(data) + size - 1) / size),
+			Ack:    ack,
+		}
+		payload, err := encodeFrame(frameManifest, m)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		pieces = append(pieces, payload)
+		for i := uint32(0); i < m.Chunks; i++ {
+			end := (int(i) + 1) * size
+			if end > len(data) {
+				end = len(data)
+			}
+			payload, err := encodeFrame(frameChunk, &chunk{id, i, data[int(i)*size : end]})
+			if err != nil {
+				return common.Hash{}, err
+			}
+			pieces = append(pieces, payload)
+		}
+	}
+
+	if !ack {
+		return n.sendPieces(ctx, pieces, nil, opts)
+	}
+	acks := n.expectAcks(id, n.recipient(opts))
+	defer n.forgetAcks(id)
+	hash, err := n.sendPieces(ctx, pieces, nil, opts)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return hash, n.awaitAcks(ctx, id, pieces, opts, acks)
+}
+
+// sendPieces sends the pieces of a file with the given indexes, or all of
+// them if which is nil, at most one per chunkInterval. It returns the hash
+// of the first envelope sent.
+func (n *Node) sendPieces(ctx context.Context, pieces [][]byte, which []int, opts *SendOptions) (common.Hash, error) {
+	if which == nil {
+		for i := range pieces {
+			which = append(which, i)
+		}
+	}
+	var first common.Hash
+	for k, i := range which {
+		if k > 0 {
+			select {
+			case <-time.After(chunkInterval):
+			case <-ctx.Done():
+				return common.Hash{}, ctx.Err()
+			}
+		}
+		h, err := n.Send(ctx, pieces[i], opts)
+		if err != nil {
+			if i == 0 {
+				return common.Hash{}, fmt.Errorf("failed to send file: %v", err)
+			}
+			return common.Hash{}, fmt.Errorf("failed to send chunk %d of %d: %v", i, len(pieces)-1, err)
+		}
+		if k == 0 {
+			first = h
+		}
+		n.log.Debug("file piece sent", "piece", i, "pieces", len(pieces), "hash", h.Hex())
+	}
+	return first, nil
+}
+
+// fileType guesses the MIME type of a file from its extension, or else
+// from its content.
+func fileType(path string, data []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(path)); len(t) > 0 {
+		return t
+	}
+	return http.DetectContentType(data)
+}
+
+// transfer is a file being received. Transfers are only accessed from the
+// message loop.
+type transfer struct {
+	manifest *manifest
+	origin   *whisper.ReceivedMessage // message the manifest came in
+	chunks   map[uint32][]byte
+	size     uint64 // bytes of the chunks
+	expiry   uint32 // latest expiry of the pieces received so far
+	done     bool   // file is saved, late duplicates are ignored
+	failure  error  // why the complete file could not be saved
+
+	ack     bool         // sender asked for acknowledgements
+	reply   *SendOptions // how acknowledgements reach the sender
+	pending bool         // pieces arrived since the last acknowledgement
+	acking  uint32       // an acknowledgement is being sent, accessed atomically
+}
+
+// receiveTransfer handles msg if it carries a file, a piece of one or an
+// acknowledgement, and reports whether it did.
+func (n *Node) receiveTransfer(msg *whisper.ReceivedMessage, subscription string) bool {
+	kind, body, ok := decodeFrame(msg.Payload)
+	if !ok {
+		return false
+	}
+	if kind == frameAck {
+		n.receiveAck(msg, body)
+		return true
+	}
+	// without a save directory files are delivered like any other message
+	if len(n.config.ArgSaveDir) == 0 {
+		return false
+	}
+
+	var (
+		id transferID
+		f  file
+		m  manifest
+		c  chunk
+	)
+	switch kind {
+	case frameFile:
+		if err := rlp.DecodeBytes(body, &f); err != nil {
+			n.log.Warn("invalid file frame", "hash", msg.EnvelopeHash.Hex(), "err", err)
+			return true
+		}
+		if f.Header.Size > n.maxFileSize() {
+			n.log.Warn("file too large", "hash", msg.EnvelopeHash.Hex(), "name", f.Header.Name, "size", f.Header.Size)
+			return true
+		}
+		id = f.ID
+	case frameManifest:
+		if err := rlp.DecodeBytes(body, &m); err != nil || m.Chunks == 0 {
+			n.log.Warn("invalid transfer manifest", "hash", msg.EnvelopeHash.Hex(), "err", err)
+			return true
+		}
+		if m.Header.Size > n.maxFileSize() || m.Chunks > n.maxChunks() {
+			n.log.Warn("file too large", "hash", msg.EnvelopeHash.Hex(), "name", m.Header.Name, "size", m.Header.Size, "chunks", m.Chunks)
+			return true
+		}
+		id = m.ID
+	case frameChunk:
+		if err := rlp.DecodeBytes(body, &c); err != nil {
+			n.log.Warn("invalid transfer chunk", "hash", msg.EnvelopeHash.Hex(), "err", err)
+			return true
+		}
+		id = c.ID
+	default:
+		n.log.Warn("unknown transfer frame", "hash", msg.EnvelopeHash.Hex(), "kind", kind)
+		return true
+	}
+
+	t := n.transfers[id]
+	if t == nil {
+		if kind != frameFile && n.receiving() >= int(n.config.ArgMaxTransfers) {
+			n.log.Warn("too many files being received, piece dropped", "transfer", fmt.Sprintf("%x", id))
+			return true
+		}
+		t = &transfer{chunks: make(map[uint32][]byte)}
+		n.transfers[id] = t
+	}
+	if expiry := msg.Sent + msg.TTL; expiry > t.expiry {
+		t.expiry = expiry
+	}
+	if (kind == frameFile && f.Ack || kind == frameManifest && m.Ack) && !n.fromSelf(msg) {
+		t.ack = true
+		if t.reply == nil {
+			t.reply = n.replyOptions(msg, subscription)
+		}
+	}
+	// a retransmission after the file was saved means the sender
+	// missed the acknowledgement
+	t.pending = true
+	if t.done {
+		return true
+	}
+
+	switch kind {
+	case frameFile:
+		t.failure = n.saveFile(&f.Header, f.Data, msg, 0)
+		t.done = true
+	case frameManifest:
+		if t.manifest == nil {
+			t.manifest, t.origin = &m, msg
+			// chunks that arrived before the manifest may lie beyond it
+			for i, data := range t.chunks {
+				if i >= m.Chunks {
+					delete(t.chunks, i)
+					n.release(t, data)
+				}
+			}
+		}
+	case frameChunk:
+		switch _, dup := t.chunks[c.Index]; {
+		case dup:
+		case t.manifest != nil && c.Index >= t.manifest.Chunks:
+			n.log.Warn("transfer chunk beyond the manifest", "transfer", fmt.Sprintf("%x", id), "index", c.Index, "chunks", t.manifest.Chunks)
+		case n.buffered+uint64(len(c.Data)) > uint64(n.config.ArgTransferMem)*megabyte:
+			n.log.Warn("transfer buffer is full, chunk dropped", "transfer", fmt.Sprintf("%x", id), "index", c.Index)
+		default:
+			t.chunks[c.Index] = c.Data
+			t.size += uint64(len(c.Data))
+			n.buffered += uint64(len(c.Data))
+		}
+	}
+
+	if !t.done && t.complete() {
+		var data []byte
+		for i := uint32(0); i < t.manifest.Chunks; i++ {
+			data = append(data, t.chunks[i]...)
+		}
+		t.failure = n.saveFile(&t.manifest.Header, data, t.origin, t.manifest.Chunks)
+		n.buffered -= t.size
+		t.done, t.chunks, t.size = true, nil, 0
+	}
+	if t.done {
+		if t.failure != nil {
+			name := f.Header.Name
+			if t.manifest != nil {
+				name = t.manifest.Header.Name
+			}
+			n.reportUnsaved(name, t.failure)
+		}
+		n.acknowledge(id, t)
+	}
+	return true
+}
+
+// complete reports whether all chunks of t arrived. Only chunks within the
+// manifest are kept once it is known.
+func (t *transfer) complete() bool {
+	return t.manifest != nil && uint32(len(t.chunks)) == t.manifest.Chunks
+}
+
+// release forgets data, a chunk of t that is dropped.
+func (n *Node) release(t *transfer, data []byte) {
+	t.size -= uint64(len(data))
+	n.buffered -= uint64(len(data))
+}
+
+// receiving returns the number of files being received.
+func (n *Node) receiving() int {
+	count := 0
+	for _, t := range n.transfers {
+		if !t.done {
+			count++
+		}
+	}
+	return count
+}
+
+// maxFileSize is the size in bytes of the largest file received.
+func (n *Node) maxFileSize() uint64 {
+	return uint64(n.config.ArgMaxFile) * megabyte
+}
+
+// maxChunks is the number of chunks of the largest file received. It is
+// counted in chunks of this node's size: a sender with a smaller ArgMaxSize
+// sends smaller chunks, and so smaller files.
+func (n *Node) maxChunks() uint32 {
+	size := uint64(1)
+	if n.chunkSize() > 1 {
+		size = uint64(n.chunkSize())
+	}
+	chunks := (n.maxFileSize() + size - 1) / size
+	if chunks > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(chunks)
+}
+
+// saveFile verifies a received file against its header and saves it in
+// ArgSaveDir under its original name, along with its FileInfo sidecar.
+// Neither overwrites an existing file; if the name or the name of the
+// sidecar is taken, a part of the hash of the envelope the file or its
+// manifest came in is appended to the name, followed by a counter if
+// needed.
+func (n *Node) saveFile(h *fileHeader, data []byte, origin *whisper.ReceivedMessage, chunks uint32) error {
+	if isSidecarName(h.Name) {
+		return fmt.Errorf("file name ends in %s", sidecarExt)
+	}
+	if uint64(len(data)) != h.Size {
+		return fmt.Errorf("size mismatch: got %d bytes, want %d", len(data), h.Size)
+	}
+	if sha256.Sum256(data) != h.SHA256 {
+		return errors.New("SHA-256 mismatch")
+	}
+
+	name := filepath.Base(h.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = fmt.Sprintf("%x", origin.EnvelopeHash)
+	}
+	base := filepath.Join(n.config.ArgSaveDir, name)
+
+	info := &FileInfo{
+		Name:     h.Name,
+		MIME:     h.MIME,
+		Size:     h.Size,
+		SHA256:   h.SHA256,
+		Topic:    origin.Topic,
+		Envelope: origin.EnvelopeHash,
+		Chunks:   chunks,
+		Sent:     time.Unix(int64(origin.Sent), 0),
+		Received: time.Now(),
+	}
+	var address common.Address
+	if origin.Src != nil {
+		address = crypto.PubkeyToAddress(*origin.Src)
+		info.Sender = &address
+	}
+	sidecar, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path, err := saveExclusive(base, origin.EnvelopeHash, data, sidecar)
+	if err != nil {
+		return err
+	}
+	n.log.Info("file saved", "hash", origin.EnvelopeHash.Hex(), "path", path, "mime", h.MIME, "size", len(data))
+	if n.interactive {
+		fmt.Printf("\n%d {%x}: file received and saved as '%s' (%s, %d bytes)\n", origin.Sent, address, path, h.MIME, len(data))
+	}
+	return nil
+}
+
+// saveExclusive writes data and its sidecar under the first name derived
+// from base for which neither exists yet, and returns the path of the data.
+func saveExclusive(base string, hash common.Hash, data, sidecar []byte) (string, error) {
+	for i := 0; i < maxSaveAttempts; i++ {
+		path := base
+		switch {
+		case i == 1:
+			path = fmt.Sprintf("%s.%x", base, hash[:4])
+		case i > 1:
+			path = fmt.Sprintf("%s.%x-%d", base, hash[:4], i)
+		}
+		err := writeExclusive(path, data)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		err = writeExclusive(path+sidecarExt, sidecar)
+		if err == nil {
+			return path, nil
+		}
+		os.Remove(path)
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free name for %s after %d attempts", base, maxSaveAttempts)
+}
+
+// writeExclusive writes data to a new file at path; it fails with an error
+// satisfying os.IsExist if the file exists.
+func writeExclusive(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// isSidecarName reports whether a file name is reserved for sidecars.
+func isSidecarName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), sidecarExt)
+}
+
+func (n *Node) reportUnsaved(name string, err error) {
+	n.log.Warn("received file not saved", "name", name, "err", err)
+	if n.interactive {
+		fmt.Printf("\nfile %s was received but not saved: %s\n", name, err)
+	}
+}
+
+// expireTransfers forgets the transfers whose pieces have all expired and
+// reports those that never completed.
+func (n *Node) expireTransfers(now time.Time) {
+	for id, t := range n.transfers {
+		if t.expiry+whisper.DefaultSyncAllowance >= uint32(now.Unix()) {
+			continue
+		}
+		delete(n.transfers, id)
+		n.buffered -= t.size
+		if t.done {
+			continue
+		}
+
+		name, chunks := "<unknown>", "?"
+		if t.manifest != nil {
+			name, chunks = t.manifest.Header.Name, fmt.Sprint(t.manifest.Chunks)
+		}
+		n.log.Warn("incomplete file transfer expired", "transfer", fmt.Sprintf("%x", id), "name", name, "chunks", len(t.chunks), "of", chunks)
+		if n.interactive {
+			fmt.Printf("\nfile %s was not received: %d of %s chunks arrived before the TTL expired\n", name, len(t.chunks), chunks)
+		}
+	}
+}
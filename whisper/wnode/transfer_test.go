@@ -0,0 +1,151 @@
+package wnode
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// newReceiver returns a node that saves files into a temporary directory,
+// without starting it: receiveTransfer only needs the config.
+func newReceiver(t *testing.T) *Node {
+	dir, err := ioutil.TempDir("", "wnode-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.ArgSaveDir = dir
+	n := NewNode(c)
+	n.transfers = make(map[transferID]*transfer)
+	return n
+}
+
+func receiveFrame(t *testing.T, n *Node, kind byte, frame interface{}) {
+	payload, err := encodeFrame(kind, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.receiveTransfer(&whisper.ReceivedMessage{Payload: payload}, "test") {
+		t.Fatal("frame not handled as a transfer")
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	n := newReceiver(t)
+	defer os.RemoveAll(n.config.ArgSaveDir)
+
+	huge := manifest{ID: transferID{1}, Header: fileHeader{Name: "huge"}, Chunks: math.MaxUint32}
+	receiveFrame(t, n, frameManifest, huge)
+	if len(n.transfers) != 0 {
+		t.Error("manifest of 2^32-1 chunks accepted")
+	}
+
+	data := []byte("two chunks")
+	m := manifest{
+		ID:     transferID{2},
+		Header: fileHeader{Name: "small", Size: uint64(len(data)), SHA256: sha256.Sum256(data)},
+		Chunks: 2,
+	}
+	receiveFrame(t, n, frameChunk, chunk{ID: m.ID, Index: 5, Data: []byte("early")})
+	receiveFrame(t, n, frameManifest, m)
+	receiveFrame(t, n, frameChunk, chunk{ID: m.ID, Index: 2, Data: []byte("beyond")})
+	if tr := n.transfers[m.ID]; len(tr.chunks) != 0 || n.buffered != 0 {
+		t.Fatalf("chunks beyond the manifest kept: %d chunks, %d bytes", len(tr.chunks), n.buffered)
+	}
+	receiveFrame(t, n, frameChunk, chunk{ID: m.ID, Index: 0, Data: data[:4]})
+	receiveFrame(t, n, frameChunk, chunk{ID: m.ID, Index: 1, Data: data[4:]})
+	if n.buffered != 0 {
+		t.Errorf("%d bytes buffered after the file was saved", n.buffered)
+	}
+	saved, err := ioutil.ReadFile(filepath.Join(n.config.ArgSaveDir, "small"))
+	if err != nil || string(saved) != string(data) {
+		t.Errorf("saved %q, %v; want %q", saved, err, data)
+	}
+}
+
+func TestTransferCaps(t *testing.T) {
+	n := newReceiver(t)
+	defer os.RemoveAll(n.config.ArgSaveDir)
+	n.config.ArgMaxTransfers = 2
+	n.config.ArgTransferMem = 1
+
+	for i := byte(0); i < 3; i++ {
+		receiveFrame(t, n, frameChunk, chunk{ID: transferID{i}, Data: []byte{i}})
+	}
+	if n.receiving() != 2 {
+		t.Errorf("receiving %d files, want 2", n.receiving())
+	}
+
+	big := make([]byte, megabyte/2+1)
+	receiveFrame(t, n, frameChunk, chunk{ID: transferID{0}, Index: 1, Data: big})
+	receiveFrame(t, n, frameChunk, chunk{ID: transferID{0}, Index: 2, Data: big})
+	if got := len(n.transfers[transferID{0}].chunks); got != 2 {
+		t.Errorf("%d chunks buffered, want 2", got)
+	}
+	if n.buffered > megabyte {
+		t.Errorf("%d bytes buffered, more than ArgTransferMem", n.buffered)
+	}
+}
+
+func TestSaveFileCollisions(t *testing.T) {
+	n := newReceiver(t)
+	defer os.RemoveAll(n.config.ArgSaveDir)
+	dir := n.config.ArgSaveDir
+	origin := &whisper.ReceivedMessage{EnvelopeHash: common.HexToHash("0xa1b2c3d4")}
+	tag := fmt.Sprintf("%x", origin.EnvelopeHash[:4])
+
+	// files the received ones must not replace: the name and its first
+	// alternative, and the sidecar of a file that is gone
+	existing := map[string]string{
+		"foo":           "foo",
+		"foo." + tag:    "foo, second",
+		"bar" + ".json": "sidecar of bar",
+	}
+	for name, content := range existing {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save := func(name string) error {
+		data := []byte("received " + name)
+		h := &fileHeader{Name: name, Size: uint64(len(data)), SHA256: sha256.Sum256(data)}
+		return n.saveFile(h, data, origin, 0)
+	}
+	if err := save("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := save("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := save("baz.JSON"); err == nil {
+		t.Error("file named like a sidecar saved")
+	}
+
+	for name, content := range existing {
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(data) != content {
+			t.Errorf("%s overwritten with %q", name, data)
+		}
+	}
+	for name, content := range map[string]string{
+		"foo." + tag + "-2": "received foo",
+		"bar." + tag:        "received bar",
+	} {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != content {
+			t.Errorf("%s: got %q, %v; want %q", name, data, err, content)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name+".json")); err != nil {
+			t.Errorf("sidecar of %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "baz.JSON")); !os.IsNotExist(err) {
+		t.Errorf("file named like a sidecar was written: %v", err)
+	}
+}
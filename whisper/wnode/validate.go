@@ -0,0 +1,372 @@
+package wnode
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/nat"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+const enodePrefix = "enode://"
+
+// ValidationErrors lists all problems found by Config.Validate.
+type ValidationErrors []*ConfigError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks that the modes of the config can be combined and that the
+// fields they depend on are set and well-formed. It returns nil or
+// ValidationErrors holding every problem found, not just the first one.
+//
+// Timeouts and limits must not be zero, so a config should start as a copy
+// of DefaultConfig rather than as a zero Config.
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{field, fmt.Errorf(format, args...)})
+	}
+	// positive fails a zero field, naming the value DefaultConfig gives it
+	positive := func(field string, zero bool, def interface{}) {
+		if zero {
+			fail(field, "must be positive, DefaultConfig sets %v", def)
+		}
+	}
+
+	// modes
+	if c.ForwarderMode {
+		for _, m := range []struct {
+			on   bool
+			name string
+		}{
+			{c.AsymmetricMode, "AsymmetricMode"},
+			{c.RequestMail, "RequestMail"},
+			{c.FileExMode, "FileExMode"},
+			{c.FileReader, "FileReader"},
+			{c.UseSelfPubKey, "UseSelfPubKey"},
+		} {
+			if m.on {
+				fail(m.name, "forwarder neither encrypts nor decrypts messages")
+			}
+		}
+		if len(c.ArgSaveDir) > 0 {
+			fail("ArgSaveDir", "forwarder does not save messages")
+		}
+	}
+	if c.FileReader {
+		if c.RequestMail {
+			fail("RequestMail", "file reader does not connect to peers")
+		}
+		if c.FileExMode {
+			fail("FileExMode", "file reader and file exchange modes are exclusive")
+		}
+		if c.MailServerMode {
+			fail("MailServerMode", "file reader does not connect to peers")
+		}
+		if len(c.ArgEnode) > 0 {
+			fail("ArgEnode", "file reader does not connect to peers")
+		}
+		if len(c.ArgStaticPeers) > 0 {
+			fail("ArgStaticPeers", "file reader does not connect to peers")
+		}
+		if len(c.ArgPeersFile) > 0 {
+			fail("ArgPeersFile", "file reader does not connect to peers")
+		}
+		if len(c.ArgBootFrom) > 0 {
+			fail("ArgBootFrom", "file reader does not connect to peers")
+		}
+		if len(c.ArgPublishFile) > 0 {
+			fail("ArgPublishFile", "file reader has no enode to publish")
+		}
+		if len(c.ArgPublishAddr) > 0 {
+			fail("ArgPublishAddr", "file reader has no enode to publish")
+		}
+	}
+	if c.RequestMail {
+		if c.BootstrapMode {
+			fail("RequestMail", "bootstrap node does not connect to a mail server")
+		}
+		if c.FileExMode {
+			fail("FileExMode", "mail request and file exchange modes are exclusive")
+		}
+		if len(c.ArgEnode) == 0 && len(c.ArgBootFrom) == 0 {
+			fail("ArgEnode", "mail server enode is required to request mail")
+		}
+	}
+	if c.BootstrapMode && len(c.ArgEnode) > 0 {
+		fail("ArgEnode", "bootstrap node does not connect to peers")
+	}
+	if c.BootstrapMode && len(c.ArgBootFrom) > 0 {
+		fail("ArgBootFrom", "bootstrap node does not connect to peers")
+	}
+	if c.UseSelfPubKey && !c.AsymmetricMode {
+		fail("UseSelfPubKey", "requires AsymmetricMode")
+	}
+	if c.UseSelfPubKey && len(c.ArgPub) > 0 {
+		fail("ArgPub", "can not be combined with UseSelfPubKey")
+	}
+	if len(c.ArgPub) > 0 && !c.AsymmetricMode {
+		fail("ArgPub", "requires AsymmetricMode")
+	}
+
+	if len(c.ArgBatchDir) > 0 && !c.FileReader {
+		fail("ArgBatchDir", "requires FileReader")
+	}
+	if len(c.ArgBatchOut) > 0 && len(c.ArgBatchDir) == 0 {
+		fail("ArgBatchOut", "requires ArgBatchDir")
+	}
+
+	// required fields
+	if c.FileExMode && len(c.ArgSaveDir) == 0 {
+		fail("ArgSaveDir", "parameter 'savedir' is mandatory for file exchange mode")
+	}
+	if c.MailServerMode && len(c.ArgDBPath) == 0 && c.ArgDBType != StoreMemory {
+		fail("ArgDBPath", "path to the DB is mandatory for mail server mode")
+	}
+	if c.CompactMode {
+		if c.ArgDBType == StoreMemory {
+			fail("ArgDBType", "memory DB can not be compacted")
+		} else if len(c.ArgDBPath) == 0 {
+			fail("ArgDBPath", "path to the DB is mandatory for compact mode")
+		}
+	}
+	if len(c.ArgMailAllow) > 0 {
+		if _, err := loadPublicKeys(c.ArgMailAllow); err != nil {
+			fail("ArgMailAllow", "%v", err)
+		}
+	} else if len(c.ArgArchiveAddr) > 0 {
+		// any key signs a call, the allowlist is what authorizes it
+		fail("ArgArchiveAddr", "requires ArgMailAllow")
+	}
+	if len(c.ArgArchiveHosts) > 0 && len(c.ArgArchiveAddr) == 0 {
+		fail("ArgArchiveHosts", "requires ArgArchiveAddr")
+	}
+	for _, a := range []struct {
+		set   bool
+		field string
+	}{
+		{len(c.ArgMailAllow) > 0, "ArgMailAllow"},
+		{c.ArgMailRate > 0, "ArgMailRate"},
+		{len(c.ArgMailLog) > 0, "ArgMailLog"},
+		{len(c.ArgArchiveAddr) > 0, "ArgArchiveAddr"},
+		{len(c.ArgSyncPeers) > 0, "ArgSyncPeers"},
+	} {
+		if a.set && !c.MailServerMode {
+			fail(a.field, "requires MailServerMode")
+		}
+	}
+	if len(c.ArgArchivePass) > 0 && len(c.ArgArchiveKeyFile) > 0 {
+		fail("ArgArchiveKeyFile", "can not be combined with ArgArchivePass")
+	}
+	if len(c.ArgArchiveKeyFile) > 0 {
+		if _, err := loadArchiveKey(c.ArgArchiveKeyFile); err != nil {
+			fail("ArgArchiveKeyFile", "%v", err)
+		}
+	}
+	if len(c.ArgMigrateFrom) > 0 {
+		switch {
+		case !c.encryptsArchive():
+			fail("ArgMigrateFrom", "requires ArgArchivePass or ArgArchiveKeyFile")
+		case c.ArgDBType == StoreMemory:
+			fail("ArgDBType", "memory DB can not be migrated")
+		case len(c.ArgDBPath) == 0:
+			fail("ArgDBPath", "path to the encrypted DB is mandatory for migration")
+		case c.ArgMigrateFrom == c.ArgDBPath:
+			fail("ArgMigrateFrom", "must differ from ArgDBPath")
+		}
+	}
+	switch c.ArgLogFormat {
+	case "", LogTerminal, LogJSON:
+	default:
+		fail("ArgLogFormat", "unknown log format %q", c.ArgLogFormat)
+	}
+	switch c.ArgDBType {
+	case "", StoreLevelDB, StoreBolt, StoreMemory:
+	default:
+		fail("ArgDBType", "unknown DB type %q", c.ArgDBType)
+	}
+	if c.MailServerMode && c.retention().limited() && c.ArgPruneTime == 0 {
+		fail("ArgPruneTime", "must be positive when a retention limit is set")
+	}
+	if len(c.ArgSyncPeers) > 0 {
+		if c.ArgSyncTime == 0 {
+			fail("ArgSyncTime", "must be positive when ArgSyncPeers is set")
+		}
+		if c.ArgSyncAge == 0 {
+			fail("ArgSyncAge", "must be positive when ArgSyncPeers is set")
+		}
+	}
+
+	// values
+	if len(c.ArgSaveDir) > 0 {
+		if _, err := os.Stat(c.ArgSaveDir); os.IsNotExist(err) {
+			fail("ArgSaveDir", "download directory '%s' does not exist", c.ArgSaveDir)
+		}
+	}
+	if len(c.ArgBatchDir) > 0 {
+		if fi, err := os.Stat(c.ArgBatchDir); err != nil || !fi.IsDir() {
+			fail("ArgBatchDir", "'%s' is not a directory", c.ArgBatchDir)
+		}
+	}
+	if _, err := parseEnodes(c.ArgEnode); err != nil {
+		fail("ArgEnode", "%v", err)
+	}
+	if _, err := parseEnodes(c.ArgStaticPeers); err != nil {
+		fail("ArgStaticPeers", "%v", err)
+	}
+	for _, src := range splitList(c.ArgBootFrom) {
+		if isURL(src) {
+			if _, err := url.Parse(src); err != nil {
+				fail("ArgBootFrom", "%v", err)
+			}
+		}
+	}
+	if len(c.ArgPeersFile) > 0 {
+		if _, err := loadPeers(c.ArgPeersFile); err != nil {
+			fail("ArgPeersFile", "%v", err)
+		}
+	}
+	if len(c.ArgTopic) > 0 {
+		if _, err := parseTopics(c.ArgTopic); err != nil {
+			fail("ArgTopic", "%v", err)
+		}
+	}
+	if len(c.ArgMailTopic) > 0 {
+		if _, err := parseTopics(c.ArgMailTopic); err != nil {
+			fail("ArgMailTopic", "%v", err)
+		}
+	}
+	if c.ArgMailTo > 0 && c.ArgMailTo < c.ArgMailFrom {
+		fail("ArgMailTo", "is before ArgMailFrom")
+	}
+	positive("ArgMailTimeout", c.ArgMailTimeout == 0, DefaultConfig.ArgMailTimeout)
+	if c.ArgMailLimit > math.MaxUint32 {
+		fail("ArgMailLimit", "exceeds %d", uint32(math.MaxUint32))
+	}
+	if c.ArgServerPage > math.MaxUint32 {
+		fail("ArgServerPage", "exceeds %d", uint32(math.MaxUint32))
+	}
+	if len(c.ArgPub) > 0 {
+		if !isKeyValid(crypto.ToECDSAPub(common.FromHex(c.ArgPub))) {
+			fail("ArgPub", "invalid public key")
+		}
+	}
+	for _, a := range []struct{ field, addr string }{
+		{"ArgIP", c.ArgIP},
+		{"ArgRPCAddr", c.ArgRPCAddr},
+		{"ArgWSAddr", c.ArgWSAddr},
+		{"ArgMetricsAddr", c.ArgMetricsAddr},
+		{"ArgPublishAddr", c.ArgPublishAddr},
+		{"ArgArchiveAddr", c.ArgArchiveAddr},
+	} {
+		if len(a.addr) > 0 {
+			if _, _, err := net.SplitHostPort(a.addr); err != nil {
+				fail(a.field, "%v", err)
+			}
+		}
+	}
+	if !c.RPCPublic {
+		for _, a := range []struct{ field, addr string }{
+			{"ArgRPCAddr", c.ArgRPCAddr},
+			{"ArgWSAddr", c.ArgWSAddr},
+		} {
+			if len(a.addr) > 0 && !isLoopback(a.addr) {
+				fail(a.field, "API is not authenticated, %s is reachable from other hosts; set RPCPublic to serve it anyway", a.addr)
+			}
+		}
+	}
+	if len(c.ArgNAT) > 0 {
+		if _, err := nat.Parse(c.ArgNAT); err != nil {
+			fail("ArgNAT", "%v", err)
+		}
+	}
+	if len(c.ArgAdvertise) > 0 {
+		if _, _, err := parseAdvertise(c.ArgAdvertise); err != nil {
+			fail("ArgAdvertise", "%v", err)
+		}
+		if len(c.ArgNAT) > 0 {
+			fail("ArgAdvertise", "can not be combined with ArgNAT")
+		}
+	}
+	positive("ArgTTL", c.ArgTTL == 0, DefaultConfig.ArgTTL)
+	if c.ArgMaxSize == 0 {
+		positive("ArgMaxSize", true, DefaultConfig.ArgMaxSize)
+	} else if c.ArgMaxSize > uint(whisper.MaxMessageSize) {
+		fail("ArgMaxSize", "must be between 1 and %d", whisper.MaxMessageSize)
+	} else if c.FileExMode && c.ArgMaxSize <= 2*transferOverhead {
+		fail("ArgMaxSize", "must exceed %d in file exchange mode", 2*transferOverhead)
+	}
+	if c.ArgPoW < 0 {
+		fail("ArgPoW", "must not be negative")
+	}
+	if c.ArgServerPoW < 0 {
+		fail("ArgServerPoW", "must not be negative")
+	}
+	positive("ArgMaxFile", c.ArgMaxFile == 0, DefaultConfig.ArgMaxFile)
+	positive("ArgMaxTransfers", c.ArgMaxTransfers == 0, DefaultConfig.ArgMaxTransfers)
+	positive("ArgTransferMem", c.ArgTransferMem == 0, DefaultConfig.ArgTransferMem)
+	positive("ArgBufferSize", c.ArgBufferSize <= 0, DefaultConfig.ArgBufferSize)
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// connectsToPeers reports whether the node dials its bootstrap node instead
+// of waiting for incoming connections.
+func (c *Config) connectsToPeers() bool {
+	return !c.BootstrapMode && !c.FileReader
+}
+
+// mailServerEnode returns the enode mail is requested from by default, the
+// first bootstrap node.
+func (c *Config) mailServerEnode() string {
+	if enodes := splitList(c.ArgEnode); len(enodes) > 0 {
+		return enodes[0]
+	}
+	return ""
+}
+
+// isLoopback reports whether the host of addr is a loopback address or
+// localhost. An empty host listens on all interfaces.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// normalizeEnodes adds the enode:// prefix to every enode of a comma
+// separated list.
+func normalizeEnodes(s string) string {
+	enodes := splitList(s)
+	for i, e := range enodes {
+		enodes[i] = normalizeEnode(e)
+	}
+	return strings.Join(enodes, ",")
+}
+
+func normalizeEnode(s string) string {
+	if !strings.HasPrefix(s, enodePrefix) {
+		return enodePrefix + s
+	}
+	return s
+}
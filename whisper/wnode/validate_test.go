@@ -0,0 +1,136 @@
+package wnode
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		fields []string // fields of the expected errors, none if valid
+	}{
+		{
+			name:   "default",
+			modify: func(c *Config) {},
+		},
+		{
+			name: "forwarder decrypts",
+			modify: func(c *Config) {
+				c.ForwarderMode = true
+				c.AsymmetricMode = true
+				c.FileReader = true
+			},
+			fields: []string{"AsymmetricMode", "FileReader"},
+		},
+		{
+			name: "bootstrap requests mail",
+			modify: func(c *Config) {
+				c.BootstrapMode = true
+				c.RequestMail = true
+			},
+			fields: []string{"ArgEnode", "RequestMail"},
+		},
+		{
+			name:   "file exchange without save dir",
+			modify: func(c *Config) { c.FileExMode = true },
+			fields: []string{"ArgSaveDir"},
+		},
+		{
+			name:   "mail server without DB",
+			modify: func(c *Config) { c.MailServerMode = true },
+			fields: []string{"ArgDBPath"},
+		},
+		{
+			name:   "memory mail server",
+			modify: func(c *Config) { c.MailServerMode, c.ArgDBType = true, StoreMemory },
+		},
+		{
+			name:   "self key without asymmetric mode",
+			modify: func(c *Config) { c.UseSelfPubKey = true },
+			fields: []string{"UseSelfPubKey"},
+		},
+		{
+			name:   "bad topic",
+			modify: func(c *Config) { c.ArgTopic = "zz" },
+			fields: []string{"ArgTopic"},
+		},
+		{
+			name:   "bad address",
+			modify: func(c *Config) { c.ArgIP = "127.0.0.1" },
+			fields: []string{"ArgIP"},
+		},
+		{
+			name:   "mail range reversed",
+			modify: func(c *Config) { c.ArgMailFrom, c.ArgMailTo = 200, 100 },
+			fields: []string{"ArgMailTo"},
+		},
+		{
+			name:   "unknown DB type",
+			modify: func(c *Config) { c.ArgDBType = "sqlite" },
+			fields: []string{"ArgDBType"},
+		},
+		{
+			name:   "loopback API",
+			modify: func(c *Config) { c.ArgRPCAddr, c.ArgWSAddr = "127.0.0.1:8545", "localhost:8546" },
+		},
+		{
+			name:   "public API",
+			modify: func(c *Config) { c.ArgRPCAddr, c.ArgWSAddr = "0.0.0.0:8545", ":8546" },
+			fields: []string{"ArgRPCAddr", "ArgWSAddr"},
+		},
+		{
+			name: "public API allowed",
+			modify: func(c *Config) {
+				c.ArgRPCAddr, c.ArgWSAddr = "0.0.0.0:8545", ":8546"
+				c.RPCPublic = true
+			},
+		},
+		{
+			name:   "archive hosts without archive address",
+			modify: func(c *Config) { c.ArgArchiveHosts = "archive.example.org" },
+			fields: []string{"ArgArchiveHosts"},
+		},
+		{
+			name: "zero config",
+			modify: func(c *Config) {
+				*c = Config{}
+			},
+			fields: []string{"ArgBufferSize", "ArgMailTimeout", "ArgMaxFile", "ArgMaxSize", "ArgMaxTransfers", "ArgTTL", "ArgTransferMem"},
+		},
+	}
+	for _, test := range tests {
+		c := DefaultConfig
+		test.modify(&c)
+		err := c.Validate()
+		if len(test.fields) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		var errs ValidationErrors
+		if !errors.As(err, &errs) {
+			t.Errorf("%s: got %v, want ValidationErrors", test.name, err)
+			continue
+		}
+		var fields []string
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+		sort.Strings(fields)
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") {
+			t.Errorf("%s: errors for %v, want %v", test.name, fields, test.fields)
+		}
+	}
+}
+
+func TestValidateZeroHint(t *testing.T) {
+	err := (&Config{}).Validate()
+	if err == nil || !strings.Contains(err.Error(), "DefaultConfig sets 30") {
+		t.Errorf("error of a zero config does not point at DefaultConfig: %v", err)
+	}
+}
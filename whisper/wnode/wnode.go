@@ -21,29 +21,30 @@ package wnode
 
 import (
 	"bufio"
+	"context"
 	"crypto/ecdsa"
 	crand "crypto/rand"
 	"crypto/sha512"
-	"encoding/binary"
 	"encoding/hex"
-	"flag"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/console"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/discover"
-	"github.com/ethereum/go-ethereum/p2p/nat"
-	"github.com/ethereum/go-ethereum/whisper/mailserver"
+	"github.com/ethereum/go-ethereum/rlp"
 	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
 	"golang.org/x/crypto/pbkdf2"
 )
@@ -51,585 +52,789 @@ import (
 const quitCommand = "~Q"
 const entropySize = 32
 
-// config
-var config *Config
+var input = bufio.NewReader(os.Stdin)
+
+// Node is a single Whisper node built from a Config. Unlike the package-level
+// singletons it replaces, several nodes (boot, plain, archive) can live side
+// by side in one process.
+type Node struct {
+	dropped uint64 // accessed atomically, kept first for alignment
+
+	config *Config
 
-// singletons
-var (
 	server     *p2p.Server
 	shh        *whisper.Whisper
 	done       chan struct{}
-	mailServer mailserver.WMailServer
+	mailServer mailServer
 	entropy    [entropySize]byte
 
-	input = bufio.NewReader(os.Stdin)
-)
-
-// encryption
-var (
+	// encryption
 	symKey  []byte
 	pub     *ecdsa.PublicKey
 	asymKey *ecdsa.PrivateKey
 	nodeid  *ecdsa.PrivateKey
-	topic   whisper.TopicType
-
-	asymKeyID    string
-	asymFilterID string
-	symFilterID  string
-	symPass      string
-	msPassword   string
-)
+	topics  []whisper.TopicType
+
+	asymKeyID  string
+	symPass    string
+	msPassword string
+
+	subsMu sync.RWMutex
+	subs   map[string]*subscription
+
+	envelopes   chan *whisper.Envelope
+	messages    chan *Message
+	interactive bool // print received messages to the console
+	transfers   map[transferID]*transfer
+	buffered    uint64 // bytes of the chunks held by the transfers
+
+	outMu    sync.Mutex
+	outgoing map[transferID]*outgoing
+
+	watchMu     sync.Mutex
+	watchers    map[int]func(*Message)
+	nextWatcher int
+
+	started  uint32 // 1 once Start succeeded and Stop has something to stop, accessed atomically
+	stopOnce sync.Once
+
+	rpc        *rpcServer
+	archive    *archiveServer
+	metrics    *nodeMetrics
+	publish    *http.Server
+	publishURL string
+	published  string // file the enode was published to, removed by Stop
+	peers      *peerManager
+	log        log.Logger
+}
 
-func StartNode(cfg *Config) {
-	config = cfg
-	processArgs()
-	initialize()
-	run()
-	shutdown()
+// NewNode creates a node from a copy of cfg, so the caller may reuse
+// (or keep modifying) its config for other nodes.
+func NewNode(cfg *Config) *Node {
+	c := *cfg
+	return &Node{config: &c, log: newLogger(&c), messages: make(chan *Message, c.ArgBufferSize)}
 }
 
-func processArgs() {
-	flag.Parse()
+// StartNode runs an interactive node on the console until the quit command
+// is typed.
+func StartNode(cfg *Config) error {
+	if cfg.GenerateKey {
+		return generateKey()
+	}
+	if cfg.CompactMode {
+		return compactArchive(cfg)
+	}
+	if len(cfg.ArgMigrateFrom) > 0 {
+		return migrateArchive(cfg)
+	}
 
-	if len(config.ArgIDFile) > 0 {
-		var err error
-		nodeid, err = crypto.LoadECDSA(config.ArgIDFile)
-		if err != nil {
-			utils.Fatalf("Failed to load file [%s]: %s.", config.ArgIDFile, err)
+	n := NewNode(cfg)
+	n.interactive = true
+	if err := n.Start(context.Background()); err != nil {
+		return err
+	}
+	defer n.Stop()
+	return n.run()
+}
+
+// Start initializes the node and starts the p2p server and whisper protocol.
+// Unless the node is in bootstrap mode, Start waits until at least one peer
+// is connected or ctx is done.
+func (n *Node) Start(ctx context.Context) error {
+	if err := n.config.Validate(); err != nil {
+		return err
+	}
+	if err := n.processArgs(); err != nil {
+		return err
+	}
+	if len(n.config.ArgBootFrom) > 0 {
+		if err := n.resolveBoot(ctx); err != nil {
+			return err
 		}
 	}
+	if err := n.initialize(); err != nil {
+		n.abort()
+		return err
+	}
+	if err := n.startServer(ctx); err != nil {
+		n.abort()
+		return err
+	}
+	n.shh.Start(nil)
+	atomic.StoreUint32(&n.started, 1)
 
-	if len(config.ArgPrivateKeyFile) > 0 {
-		var err error
-		asymKey, err = crypto.LoadECDSA(config.ArgPrivateKeyFile)
-		if err != nil {
-			utils.Fatalf("Failed to load file [%s]: %s.", config.ArgPrivateKeyFile, err)
+	if !n.config.ForwarderMode {
+		go n.messageLoop()
+	}
+	if n.config.MailServerMode && n.config.retention().limited() {
+		go n.pruneLoop()
+	}
+	if len(n.config.ArgSyncPeers) > 0 {
+		go n.syncLoop()
+	}
+	if len(n.config.ArgRPCAddr) > 0 || len(n.config.ArgWSAddr) > 0 {
+		if err := n.startRPC(); err != nil {
+			n.Stop()
+			return err
+		}
+	}
+	if len(n.config.ArgArchiveAddr) > 0 {
+		if err := n.startArchiveAPI(); err != nil {
+			n.Stop()
+			return err
+		}
+	}
+	if len(n.config.ArgMetricsAddr) > 0 {
+		if err := n.startMetrics(); err != nil {
+			n.Stop()
+			return err
 		}
 	}
+	if len(n.config.ArgPublishFile) > 0 || len(n.config.ArgPublishAddr) > 0 {
+		if err := n.startPublish(); err != nil {
+			n.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop shuts down the JSON-RPC API, the metrics, the message loop, the p2p
+// server, whisper and the mail server.
+//
+// Stop may be called more than once, and on a node that was never started.
+func (n *Node) Stop() {
+	if !n.running() {
+		return
+	}
+	n.stopOnce.Do(n.stop)
+}
+
+// running reports whether Start succeeded.
+func (n *Node) running() bool {
+	return atomic.LoadUint32(&n.started) == 1
+}
+
+// abort releases what a failed Start acquired. The store of the mail server
+// in particular must be closed, or a retry could not open it again.
+func (n *Node) abort() {
+	if n.done != nil {
+		close(n.done)
+	}
+	if n.server != nil {
+		n.server.Stop()
+	}
+	n.mailServer.Close()
+}
+
+func (n *Node) stop() {
+	if n.rpc != nil {
+		n.rpc.stop()
+	}
+	n.stopArchiveAPI()
+	n.stopMetrics()
+	n.stopPublish()
+	close(n.done)
+	n.stopServer()
+	if n.config.ForwarderMode {
+		close(n.messages)
+	}
+}
+
+func (n *Node) stopServer() {
+	n.shh.Stop()
+	n.server.Stop()
+	n.mailServer.Close()
+}
+
+// Config returns the node's own copy of the configuration.
+func (n *Node) Config() *Config { return n.config }
+
+// Server returns the underlying p2p server.
+func (n *Node) Server() *p2p.Server { return n.server }
+
+// Whisper returns the underlying whisper protocol instance.
+func (n *Node) Whisper() *whisper.Whisper { return n.shh }
+
+// Enode returns the enode URL other nodes can use to connect to this node,
+// or an empty string before Start.
+func (n *Node) Enode() string {
+	if !n.running() {
+		return ""
+	}
+	return n.self().String()
+}
+
+// Topic returns the topic messages are sent with by default, the first of
+// the topics the node's own subscriptions listen to.
+func (n *Node) Topic() whisper.TopicType {
+	if len(n.topics) == 0 {
+		return whisper.TopicType{}
+	}
+	return n.topics[0]
+}
+
+// Topics returns the topics the node's own subscriptions listen to.
+func (n *Node) Topics() []whisper.TopicType { return n.topics }
+
+// PublicKey returns the public part of the node's asymmetric encryption key,
+// or nil before Start.
+func (n *Node) PublicKey() *ecdsa.PublicKey {
+	if !n.running() {
+		return nil
+	}
+	return &n.asymKey.PublicKey
+}
+
+// PeerPublicKey returns the public key messages are encrypted with in
+// asymmetric mode.
+func (n *Node) PeerPublicKey() *ecdsa.PublicKey { return n.pub }
+
+// SymKey returns the symmetric key derived from the password.
+func (n *Node) SymKey() []byte { return n.symKey }
 
-	const enodePrefix = "enode://"
-	if len(config.ArgEnode) > 0 {
-		if (config.ArgEnode)[:len(enodePrefix)] != enodePrefix {
-			config.ArgEnode = enodePrefix + config.ArgEnode
+func (n *Node) processArgs() error {
+	if len(n.config.ArgIDFile) > 0 {
+		var err error
+		n.nodeid, err = crypto.LoadECDSA(n.config.ArgIDFile)
+		if err != nil {
+			return &KeyError{"node id", fmt.Errorf("failed to load file [%s]: %s", n.config.ArgIDFile, err)}
 		}
 	}
 
-	if len(config.ArgTopic) > 0 {
-		x, err := hex.DecodeString(config.ArgTopic)
+	if len(n.config.ArgPrivateKeyFile) > 0 {
+		var err error
+		n.asymKey, err = crypto.LoadECDSA(n.config.ArgPrivateKeyFile)
 		if err != nil {
-			utils.Fatalf("Failed to parse the topic: %s", err)
+			return &KeyError{"private key", fmt.Errorf("failed to load file [%s]: %s", n.config.ArgPrivateKeyFile, err)}
 		}
-		topic = whisper.BytesToTopic(x)
 	}
 
-	if config.AsymmetricMode && len(config.ArgPub) > 0 {
-		pub = crypto.ToECDSAPub(common.FromHex(config.ArgPub))
-		if !isKeyValid(pub) {
-			utils.Fatalf("invalid public key")
+	n.config.ArgEnode = normalizeEnodes(n.config.ArgEnode)
+	n.config.ArgStaticPeers = normalizeEnodes(n.config.ArgStaticPeers)
+
+	if len(n.config.ArgTopic) > 0 {
+		var err error
+		if n.topics, err = parseTopics(n.config.ArgTopic); err != nil {
+			return &ConfigError{"ArgTopic", err}
 		}
 	}
 
-	if len(config.ArgSaveDir) > 0 {
-		if _, err := os.Stat(config.ArgSaveDir); os.IsNotExist(err) {
-			utils.Fatalf("Download directory '%s' does not exist", config.ArgSaveDir)
+	if n.config.AsymmetricMode && len(n.config.ArgPub) > 0 {
+		n.pub = crypto.ToECDSAPub(common.FromHex(n.config.ArgPub))
+		if !isKeyValid(n.pub) {
+			return &KeyError{"public key", errors.New("invalid public key")}
 		}
-	} else if config.FileExMode {
-		utils.Fatalf("Parameter 'savedir' is mandatory for file exchange mode")
 	}
 
-	if config.EchoMode {
-		echo()
+	if n.config.EchoMode {
+		n.echo()
 	}
+	return nil
 }
 
-func echo() {
-	fmt.Printf("ttl = %d \n", config.ArgTTL)
-	fmt.Printf("workTime = %d \n", config.ArgWorkTime)
-	fmt.Printf("pow = %f \n", config.ArgPoW)
-	fmt.Printf("mspow = %f \n", config.ArgServerPoW)
-	fmt.Printf("ip = %s \n", config.ArgIP)
-	fmt.Printf("pub = %s \n", common.ToHex(crypto.FromECDSAPub(pub)))
-	fmt.Printf("idfile = %s \n", config.ArgIDFile)
-	fmt.Printf("dbpath = %s \n", config.ArgDBPath)
-	fmt.Printf("boot = %s \n", config.ArgEnode)
+func (n *Node) echo() {
+	fmt.Printf("ttl = %d \n", n.config.ArgTTL)
+	fmt.Printf("workTime = %d \n", n.config.ArgWorkTime)
+	fmt.Printf("pow = %f \n", n.config.ArgPoW)
+	fmt.Printf("mspow = %f \n", n.config.ArgServerPoW)
+	fmt.Printf("ip = %s \n", n.config.ArgIP)
+	fmt.Printf("advertise = %s \n", n.config.ArgAdvertise)
+	fmt.Printf("nat = %s \n", n.config.ArgNAT)
+	fmt.Printf("pub = %s \n", common.ToHex(crypto.FromECDSAPub(n.pub)))
+	fmt.Printf("idfile = %s \n", n.config.ArgIDFile)
+	fmt.Printf("dbpath = %s \n", n.config.ArgDBPath)
+	fmt.Printf("boot = %s \n", n.config.ArgEnode)
+	fmt.Printf("peers = %s \n", n.config.ArgStaticPeers)
 }
 
-func initialize() {
-	log.Root().SetHandler(log.LvlFilterHandler(log.Lvl(config.ArgVerbosity), log.StreamHandler(os.Stderr, log.TerminalFormat(false))))
-
-	done = make(chan struct{})
-	var peers []*discover.Node
+func (n *Node) initialize() error {
+	n.done = make(chan struct{})
+	n.subs = make(map[string]*subscription)
+	n.watchers = make(map[int]func(*Message))
+	n.transfers = make(map[transferID]*transfer)
+	n.outgoing = make(map[transferID]*outgoing)
+	n.envelopes = make(chan *whisper.Envelope, envelopeQueueSize)
+	var boot, static []*discover.Node
 	var err error
 
-	if config.GenerateKey {
-		key, err := crypto.GenerateKey()
-		if err != nil {
-			utils.Fatalf("Failed to generate private key: %s", err)
-		}
-		k := hex.EncodeToString(crypto.FromECDSA(key))
-		fmt.Printf("Random private key: %s \n", k)
-		os.Exit(0)
-	}
-
-	if config.TestMode {
-		symPass = "wwww" // ascii code: 0x77777777
-		msPassword = "wwww"
+	if n.config.TestMode {
+		n.symPass = "wwww" // ascii code: 0x77777777
+		n.msPassword = "wwww"
 	}
-	if config.ArgSymPass != "" {
-		symPass = config.ArgSymPass
-		msPassword = config.ArgSymPass
+	if n.config.ArgSymPass != "" {
+		n.symPass = n.config.ArgSymPass
+		n.msPassword = n.config.ArgSymPass
 	}
 
-	if config.BootstrapMode {
-		if len(config.ArgIP) == 0 {
-			config.ArgIP = *scanLineA("Please enter your IP and port (e.g. 127.0.0.1:30348): ")
+	if n.config.BootstrapMode {
+		if len(n.config.ArgIP) == 0 {
+			n.config.ArgIP, err = scanLine("Please enter your IP and port (e.g. 127.0.0.1:30348): ")
+			if err != nil {
+				return &ConfigError{"ArgIP", err}
+			}
 		}
-	} else if config.FileReader {
-		config.BootstrapMode = true
-	} else {
-		if len(config.ArgEnode) == 0 {
-			config.ArgEnode = *scanLineA("Please enter the peer's enode: ")
+	} else if n.config.connectsToPeers() {
+		if len(n.config.ArgEnode) == 0 && len(n.config.ArgStaticPeers) == 0 {
+			n.config.ArgEnode, err = scanLine("Please enter the peer's enode: ")
+			if err != nil {
+				return &ConfigError{"ArgEnode", err}
+			}
 		}
-		peer := discover.MustParseNode(config.ArgEnode)
-		peers = append(peers, peer)
+		if boot, err = parseEnodes(n.config.ArgEnode); err != nil {
+			return &ConfigError{"ArgEnode", err}
+		}
+	}
+	if static, err = parseEnodes(n.config.ArgStaticPeers); err != nil {
+		return &ConfigError{"ArgStaticPeers", err}
+	}
+	added, err := loadPeers(n.config.ArgPeersFile)
+	if err != nil {
+		return &ConfigError{"ArgPeersFile", err}
 	}
 
-	if config.MailServerMode {
-		if len(msPassword) == 0 {
-			msPassword, err = console.Stdin.PromptPassword("Please enter the Mail Server password: ")
+	if n.config.MailServerMode {
+		if len(n.msPassword) == 0 {
+			n.msPassword, err = console.Stdin.PromptPassword("Please enter the Mail Server password: ")
 			if err != nil {
-				utils.Fatalf("Failed to read Mail Server password: %s", err)
+				return &ConfigError{"ArgSymPass", fmt.Errorf("failed to read Mail Server password: %s", err)}
 			}
 		}
 	}
 
 	cfg := &whisper.Config{
-		MaxMessageSize:     uint32(config.ArgMaxSize),
-		MinimumAcceptedPOW: config.ArgPoW,
+		MaxMessageSize:     uint32(n.config.ArgMaxSize),
+		MinimumAcceptedPOW: n.config.ArgPoW,
 	}
 
-	shh = whisper.New(cfg)
+	n.shh = whisper.New(cfg)
 
-	if config.ArgPoW != whisper.DefaultMinimumPoW {
-		err := shh.SetMinimumPoW(config.ArgPoW)
+	if n.config.ArgPoW != whisper.DefaultMinimumPoW {
+		err := n.shh.SetMinimumPoW(n.config.ArgPoW)
 		if err != nil {
-			utils.Fatalf("Failed to set PoW: %s", err)
+			return &ConfigError{"ArgPoW", err}
 		}
 	}
 
-	if uint32(config.ArgMaxSize) != whisper.DefaultMaxMessageSize {
-		err := shh.SetMaxMessageSize(uint32(config.ArgMaxSize))
+	if uint32(n.config.ArgMaxSize) != whisper.DefaultMaxMessageSize {
+		err := n.shh.SetMaxMessageSize(uint32(n.config.ArgMaxSize))
 		if err != nil {
-			utils.Fatalf("Failed to set max message size: %s", err)
+			return &ConfigError{"ArgMaxSize", err}
 		}
 	}
 
-	if asymKey == nil {
-		asymKeyID, err = shh.NewKeyPair()
+	if n.asymKey == nil {
+		n.asymKeyID, err = n.shh.NewKeyPair()
 		if err != nil {
-			utils.Fatalf("Failed to generate a new key pair: %s", err)
+			return &KeyError{"private key", fmt.Errorf("failed to generate a new key pair: %s", err)}
 		}
 
-		asymKey, err = shh.GetPrivateKey(asymKeyID)
+		n.asymKey, err = n.shh.GetPrivateKey(n.asymKeyID)
 		if err != nil {
-			utils.Fatalf("Failed to retrieve a new key pair: %s", err)
+			return &KeyError{"private key", fmt.Errorf("failed to retrieve a new key pair: %s", err)}
 		}
 	} else {
-		asymKeyID, err = shh.AddKeyPair(asymKey)
+		n.asymKeyID, err = n.shh.AddKeyPair(n.asymKey)
 		if err != nil {
-			utils.Fatalf("Failed to add a new key pair: %s", err)
+			return &KeyError{"private key", fmt.Errorf("failed to add a new key pair: %s", err)}
 		}
 	}
 
-	if nodeid == nil {
-		tmpID, err := shh.NewKeyPair()
+	if n.nodeid == nil {
+		tmpID, err := n.shh.NewKeyPair()
 		if err != nil {
-			utils.Fatalf("Failed to generate a new key pair: %s", err)
+			return &KeyError{"node id", fmt.Errorf("failed to generate a new key pair: %s", err)}
 		}
 
-		nodeid, err = shh.GetPrivateKey(tmpID)
+		n.nodeid, err = n.shh.GetPrivateKey(tmpID)
 		if err != nil {
-			utils.Fatalf("Failed to retrieve a new key pair: %s", err)
+			return &KeyError{"node id", fmt.Errorf("failed to retrieve a new key pair: %s", err)}
 		}
 	}
 
-	maxPeers := 80
-	if config.BootstrapMode {
-		maxPeers = 800
-	}
+	// every record carries the node, so that the records of several nodes
+	// can be told apart
+	n.log = n.log.New("node", discover.PubkeyID(&n.nodeid.PublicKey).TerminalString())
 
-	_, err = crand.Read(entropy[:])
+	_, err = crand.Read(n.entropy[:])
 	if err != nil {
-		utils.Fatalf("crypto/rand failed: %s", err)
+		return fmt.Errorf("crypto/rand failed: %s", err)
 	}
 
-	if config.MailServerMode {
-		shh.RegisterServer(&mailServer)
-		if err := mailServer.Init(shh, config.ArgDBPath, msPassword, config.ArgServerPoW); err != nil {
-			utils.Fatalf("Failed to init MailServer: %s", err)
+	n.metrics = newNodeMetrics(n)
+	tap := &envelopeTap{metrics: n.metrics, log: n.log}
+	if !n.config.ForwarderMode {
+		tap.envelopes = n.envelopes
+	}
+	if n.config.MailServerMode {
+		n.mailServer.metrics, n.mailServer.log = n.metrics, n.log
+		if err := n.mailServer.Init(n.shh, n.msPassword, n.config); err != nil {
+			return &MailServerError{"init", err}
 		}
+		tap.archive = &n.mailServer
 	}
+	n.shh.RegisterServer(tap)
 
-	server = &p2p.Server{
+	// boot nodes without discovery are only dialed, by the peer manager
+	var discovery []*discover.Node
+	for _, node := range boot {
+		if node.UDP != 0 {
+			discovery = append(discovery, node)
+		}
+	}
+	natm, err := n.config.natInterface()
+	if err != nil {
+		return &ConfigError{"ArgNAT", err}
+	}
+	n.server = &p2p.Server{
 		Config: p2p.Config{
-			PrivateKey:     nodeid,
-			MaxPeers:       maxPeers,
+			PrivateKey:     n.nodeid,
+			MaxPeers:       n.config.maxPeers(),
 			Name:           common.MakeName("wnode", "6.0"),
-			Protocols:      shh.Protocols(),
-			ListenAddr:     config.ArgIP,
-			NAT:            nat.Any(),
-			BootstrapNodes: peers,
-			StaticNodes:    peers,
-			TrustedNodes:   peers,
+			Protocols:      n.shh.Protocols(),
+			ListenAddr:     n.config.ArgIP,
+			NAT:            natm,
+			NoDiscovery:    n.config.NoDiscovery,
+			BootstrapNodes: discovery,
+			TrustedNodes:   append(append([]*discover.Node(nil), boot...), static...),
+			Logger:         n.log,
 		},
 	}
+
+	// the peer manager rather than the server dials the peers, with backoff
+	n.peers = newPeerManager(n.server, n.config.ArgPeersFile, n.log)
+	for _, node := range boot {
+		n.peers.add(node, PeerBoot)
+	}
+	for _, node := range static {
+		n.peers.add(node, PeerStatic)
+	}
+	for _, node := range added {
+		n.peers.add(node, PeerAdded)
+	}
+	return nil
 }
 
-func startServer() error {
-	err := server.Start()
+func generateKey() error {
+	key, err := crypto.GenerateKey()
 	if err != nil {
-		fmt.Printf("Failed to start Whisper peer: %s.", err)
-		return err
+		return &KeyError{"private key", fmt.Errorf("failed to generate private key: %s", err)}
 	}
+	k := hex.EncodeToString(crypto.FromECDSA(key))
+	fmt.Printf("Random private key: %s \n", k)
+	return nil
+}
 
-	fmt.Printf("my public key: %s \n", common.ToHex(crypto.FromECDSAPub(&asymKey.PublicKey)))
-	fmt.Println(server.NodeInfo().Enode)
+func (n *Node) startServer(ctx context.Context) error {
+	err := n.server.Start()
+	if err != nil {
+		return &NetworkError{"start server", err}
+	}
+
+	go n.logPeers()
+	go n.peerLoop()
+
+	enode := n.self().String()
+	pub := common.ToHex(crypto.FromECDSAPub(&n.asymKey.PublicKey))
+	n.log.Info("node started", "enode", enode, "pubkey", pub, "bootstrap", !n.config.connectsToPeers(),
+		"mailserver", n.config.MailServerMode, "forwarder", n.config.ForwarderMode)
+	if n.interactive {
+		fmt.Printf("my public key: %s \n", pub)
+		fmt.Println(enode)
+	}
 
-	if config.BootstrapMode {
-		configureNode()
-		fmt.Println("Bootstrap Whisper node started")
+	if !n.config.connectsToPeers() {
+		if n.interactive {
+			fmt.Println("Bootstrap Whisper node started")
+		}
 	} else {
-		fmt.Println("Whisper node started")
+		if n.interactive {
+			fmt.Println("Whisper node started")
+		}
 		// first see if we can establish connection, then ask for user input
-		waitForConnection(true)
-		configureNode()
+		err = n.waitForConnection(ctx, true)
 	}
-
-	if config.FileExMode {
-		fmt.Printf("Please type the file name to be send. To quit type: '%s'\n", quitCommand)
-	} else if config.FileReader {
-		fmt.Printf("Please type the file name to be decrypted. To quit type: '%s'\n", quitCommand)
-	} else if !config.ForwarderMode {
-		fmt.Printf("Please type the message. To quit type: '%s'\n", quitCommand)
+	if err == nil {
+		err = n.configureNode()
 	}
-	return nil
+	return err
 }
 
 func isKeyValid(k *ecdsa.PublicKey) bool {
-	return k.X != nil && k.Y != nil
+	return k != nil && k.X != nil && k.Y != nil
 }
 
-func configureNode() {
+func (n *Node) configureNode() error {
 	var err error
 	var p2pAccept bool
 
-	if config.ForwarderMode {
-		return
+	if n.config.ForwarderMode {
+		return nil
 	}
 
-	if config.AsymmetricMode {
-		if len(config.ArgPub) == 0 {
-			if config.UseSelfPubKey {
-				fmt.Println("Used self public key for listening")
-				pub = &asymKey.PublicKey
+	// a file reader only decrypts, it needs no peer key
+	if n.config.AsymmetricMode && !n.config.FileReader {
+		if len(n.config.ArgPub) == 0 {
+			if n.config.UseSelfPubKey {
+				n.log.Info("listening with the own public key")
+				if n.interactive {
+					fmt.Println("Used self public key for listening")
+				}
+				n.pub = &n.asymKey.PublicKey
 			} else {
-				s := scanLine("Please enter the peer's public key: ")
+				s, err := scanLine("Please enter the peer's public key: ")
+				if err != nil {
+					return &KeyError{"public key", err}
+				}
 				b := common.FromHex(s)
 				if b == nil {
-					utils.Fatalf("Error: can not convert hexadecimal string")
+					return &KeyError{"public key", errors.New("can not convert hexadecimal string")}
 				}
-				pub = crypto.ToECDSAPub(b)
-				if !isKeyValid(pub) {
-					utils.Fatalf("Error: invalid public key")
+				n.pub = crypto.ToECDSAPub(b)
+				if !isKeyValid(n.pub) {
+					return &KeyError{"public key", errors.New("invalid public key")}
 				}
 			}
 		}
 	}
 
-	if config.RequestMail {
+	if n.config.RequestMail {
 		p2pAccept = true
-		if len(msPassword) == 0 {
-			msPassword, err = console.Stdin.PromptPassword("Please enter the Mail Server password: ")
+		if len(n.msPassword) == 0 {
+			n.msPassword, err = console.Stdin.PromptPassword("Please enter the Mail Server password: ")
 			if err != nil {
-				utils.Fatalf("Failed to read Mail Server password: %s", err)
+				return &ConfigError{"ArgSymPass", fmt.Errorf("failed to read Mail Server password: %s", err)}
 			}
 		}
 	}
 
-	if !config.AsymmetricMode && !config.ForwarderMode {
-		if len(symPass) == 0 {
-			symPass, err = console.Stdin.PromptPassword("Please enter the password for symmetric encryption: ")
+	// a file reader tries the symmetric key along with its own key
+	if !n.config.AsymmetricMode && !n.config.ForwarderMode || n.config.FileReader && len(n.symPass) > 0 {
+		if len(n.symPass) == 0 {
+			n.symPass, err = console.Stdin.PromptPassword("Please enter the password for symmetric encryption: ")
 			if err != nil {
-				utils.Fatalf("Failed to read passphrase: %v", err)
+				return &ConfigError{"ArgSymPass", fmt.Errorf("failed to read passphrase: %v", err)}
 			}
 		}
 
-		symKeyID, err := shh.AddSymKeyFromPassword(symPass)
+		symKeyID, err := n.shh.AddSymKeyFromPassword(n.symPass)
 		if err != nil {
-			utils.Fatalf("Failed to create symmetric key: %s", err)
+			return &KeyError{"symmetric key", fmt.Errorf("failed to create symmetric key: %s", err)}
 		}
-		symKey, err = shh.GetSymKey(symKeyID)
+		n.symKey, err = n.shh.GetSymKey(symKeyID)
 		if err != nil {
-			utils.Fatalf("Failed to save symmetric key: %s", err)
+			return &KeyError{"symmetric key", fmt.Errorf("failed to save symmetric key: %s", err)}
 		}
-		if len(config.ArgTopic) == 0 {
-			generateTopic([]byte(symPass))
+		if len(n.topics) == 0 {
+			n.generateTopic([]byte(n.symPass))
 		}
 
-		fmt.Printf("Filter is configured for the topic: %x \n", topic)
-	}
-
-	if config.MailServerMode {
-		if len(config.ArgDBPath) == 0 {
-			config.ArgDBPath = *scanLineA("Please enter the path to DB file: ")
+		if n.interactive {
+			for _, t := range n.topics {
+				fmt.Printf("Filter is configured for the topic: %x \n", t)
+			}
 		}
 	}
-
-	symFilter := whisper.Filter{
-		KeySym:   symKey,
-		Topics:   [][]byte{topic[:]},
-		AllowP2P: p2pAccept,
+	if len(n.topics) == 0 {
+		n.topics = []whisper.TopicType{{}}
 	}
-	symFilterID, err = shh.Subscribe(&symFilter)
-	if err != nil {
-		utils.Fatalf("Failed to install filter: %s", err)
+
+	n.subsMu.Lock()
+	defer n.subsMu.Unlock()
+
+	if n.symKey != nil {
+		symFilter := &whisper.Filter{
+			KeySym:   n.symKey,
+			Topics:   topicsToBytes(n.topics),
+			AllowP2P: p2pAccept,
+		}
+		if err := n.install(&subscription{name: DefaultSymSubscription, sym: true}, symFilter); err != nil {
+			return err
+		}
 	}
 
-	asymFilter := whisper.Filter{
-		KeyAsym:  asymKey,
-		Topics:   [][]byte{topic[:]},
+	asymFilter := &whisper.Filter{
+		KeyAsym:  n.asymKey,
+		Topics:   topicsToBytes(n.topics),
 		AllowP2P: p2pAccept,
 	}
-	asymFilterID, err = shh.Subscribe(&asymFilter)
-	if err != nil {
-		utils.Fatalf("Failed to install filter: %s", err)
-	}
+	return n.install(&subscription{name: DefaultAsymSubscription}, asymFilter)
 }
 
-func generateTopic(password []byte) {
+func (n *Node) generateTopic(password []byte) {
+	var topic whisper.TopicType
 	x := pbkdf2.Key(password, password, 4096, 128, sha512.New)
 	for i := 0; i < len(x); i++ {
 		topic[i%whisper.TopicLength] ^= x[i]
 	}
+	n.topics = []whisper.TopicType{topic}
 }
 
-func waitForConnection(timeout bool) {
+func (n *Node) waitForConnection(ctx context.Context, timeout bool) error {
 	var cnt int
 	var connected bool
 	for !connected {
-		time.Sleep(time.Millisecond * 50)
-		connected = server.PeerCount() > 0
+		select {
+		case <-time.After(time.Millisecond * 50):
+		case <-ctx.Done():
+			return &NetworkError{"connect", ctx.Err()}
+		}
+		connected = n.server.PeerCount() > 0
 		if timeout {
 			cnt++
 			if cnt > 1000 {
-				utils.Fatalf("Timeout expired, failed to connect")
+				return &NetworkError{"connect", ErrConnectTimeout}
 			}
 		}
 	}
 
-	fmt.Println("Connected to peer.")
+	if n.interactive {
+		fmt.Println("Connected to peer.")
+	}
+	return nil
 }
 
-func run() {
-	err := startServer()
-	if err != nil {
-		return
+// run reads the user input from the console until the quit command is typed.
+func (n *Node) run() error {
+	if n.config.FileReader && len(n.config.ArgBatchDir) > 0 {
+		return n.decryptBatch()
 	}
-	defer server.Stop()
-	shh.Start(nil)
-	defer shh.Stop()
 
-	if !config.ForwarderMode {
-		go messageLoop()
+	if n.config.FileExMode {
+		fmt.Printf("Please type the file name to be send. To quit type: '%s'\n", quitCommand)
+	} else if n.config.FileReader {
+		fmt.Printf("Please type the file name to be decrypted. To quit type: '%s'\n", quitCommand)
+	} else if !n.config.ForwarderMode {
+		fmt.Printf("Please type the message. To quit type: '%s'\n", quitCommand)
 	}
 
-	if config.RequestMail {
-		requestExpiredMessagesLoop()
-	} else if config.FileExMode {
-		sendFilesLoop()
-	} else if config.FileReader {
-		fileReaderLoop()
-	} else {
-		sendLoop()
+	if n.config.RequestMail {
+		return n.requestExpiredMessagesLoop()
+	} else if n.config.FileExMode {
+		return n.sendFilesLoop()
+	} else if n.config.FileReader {
+		return n.fileReaderLoop()
 	}
+	return n.sendLoop()
 }
 
-func shutdown() {
-	close(done)
-	mailServer.Close()
-}
-
-func sendLoop() {
+func (n *Node) sendLoop() error {
 	for {
-		s := scanLine("")
+		s, err := scanLine("")
+		if err != nil {
+			return err
+		}
 		if s == quitCommand {
 			fmt.Println("Quit command received")
-			return
+			return nil
 		}
-		sendMsg([]byte(s))
-		if config.AsymmetricMode {
+		n.sendMsg([]byte(s))
+		if n.config.AsymmetricMode {
 			// print your own message for convenience,
 			// because in asymmetric mode it is impossible to decrypt it
 			timestamp := time.Now().Unix()
-			from := crypto.PubkeyToAddress(asymKey.PublicKey)
+			from := crypto.PubkeyToAddress(n.asymKey.PublicKey)
 			fmt.Printf("\n%d <%x>: %s\n", timestamp, from, s)
 		}
 	}
 }
 
-func sendFilesLoop() {
+func (n *Node) sendFilesLoop() error {
 	for {
-		s := scanLine("")
+		s, err := scanLine("")
+		if err != nil {
+			return err
+		}
 		if s == quitCommand {
 			fmt.Println("Quit command received")
-			return
+			return nil
 		}
-		b, err := ioutil.ReadFile(s)
+		h, err := n.SendFile(context.Background(), s, nil)
 		if err != nil {
 			fmt.Printf(">>> Error: %s \n", err)
 		} else {
-			h := sendMsg(b)
-			if (h == common.Hash{}) {
-				fmt.Printf(">>> Error: message was not sent \n")
+			timestamp := time.Now().Unix()
+			from := crypto.PubkeyToAddress(n.asymKey.PublicKey)
+			if n.config.ArgAckTime > 0 {
+				fmt.Printf("\n%d <%x>: file delivered, first message hash %x\n", timestamp, from, h)
 			} else {
-				timestamp := time.Now().Unix()
-				from := crypto.PubkeyToAddress(asymKey.PublicKey)
 				fmt.Printf("\n%d <%x>: sent message with hash %x\n", timestamp, from, h)
 			}
 		}
 	}
 }
 
-func fileReaderLoop() {
-	watcher1 := shh.GetFilter(symFilterID)
-	watcher2 := shh.GetFilter(asymFilterID)
-	if watcher1 == nil && watcher2 == nil {
-		fmt.Println("Error: neither symmetric nor asymmetric filter is installed")
-		return
+func (n *Node) fileReaderLoop() error {
+	if len(n.subscriptions()) == 0 {
+		return &NetworkError{"install filter", errors.New("neither symmetric nor asymmetric filter is installed")}
 	}
 
 	for {
-		s := scanLine("")
+		s, err := scanLine("")
+		if err != nil {
+			return err
+		}
 		if s == quitCommand {
 			fmt.Println("Quit command received")
-			return
+			return nil
 		}
 		raw, err := ioutil.ReadFile(s)
 		if err != nil {
 			fmt.Printf(">>> Error: %s \n", err)
 		} else {
-			env := whisper.Envelope{Data: raw} // the topic is zero
-			msg := env.Open(watcher1)          // force-open envelope regardless of the topic
-			if msg == nil {
-				msg = env.Open(watcher2)
+			var msg *whisper.ReceivedMessage
+			env, _ := readEnvelope(raw)
+			for _, s := range n.subscriptions() {
+				if msg = env.Open(s.filter); msg != nil { // force-open envelope regardless of the topic
+					break
+				}
 			}
 			if msg == nil {
 				fmt.Printf(">>> Error: failed to decrypt the message \n")
 			} else {
-				printMessageInfo(msg)
+				n.printMessageInfo(msg)
 			}
 		}
 	}
 }
 
-func scanLine(prompt string) string {
+func scanLine(prompt string) (string, error) {
 	if len(prompt) > 0 {
 		fmt.Print(prompt)
 	}
 	txt, err := input.ReadString('\n')
 	if err != nil {
-		utils.Fatalf("input error: %s", err)
+		return "", fmt.Errorf("input error: %s", err)
 	}
 	txt = strings.TrimRight(txt, "\n\r")
-	return txt
-}
-
-func scanLineA(prompt string) *string {
-	s := scanLine(prompt)
-	return &s
+	return txt, nil
 }
 
-func scanUint(prompt string) uint32 {
-	s := scanLine(prompt)
-	i, err := strconv.Atoi(s)
+func scanUint(prompt string) (uint32, error) {
+	s, err := scanLine(prompt)
 	if err != nil {
-		utils.Fatalf("Fail to parse the lower time limit: %s", err)
+		return 0, err
 	}
-	return uint32(i)
-}
-
-func sendMsg(payload []byte) common.Hash {
-	params := whisper.MessageParams{
-		Src:      asymKey,
-		Dst:      pub,
-		KeySym:   symKey,
-		Payload:  payload,
-		Topic:    topic,
-		TTL:      uint32(config.ArgTTL),
-		PoW:      config.ArgPoW,
-		WorkTime: uint32(config.ArgWorkTime),
-	}
-
-	msg, err := whisper.NewSentMessage(&params)
+	i, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
-		utils.Fatalf("failed to create new message: %s", err)
+		return 0, fmt.Errorf("fail to parse the time limit: %s", err)
 	}
-
-	envelope, err := msg.Wrap(&params)
-	if err != nil {
-		fmt.Printf("failed to seal message: %v \n", err)
-		return common.Hash{}
-	}
-
-	err = shh.Send(envelope)
-	if err != nil {
-		fmt.Printf("failed to send message: %v \n", err)
-		return common.Hash{}
-	}
-
-	return envelope.Hash()
+	return uint32(i), nil
 }
 
-func messageLoop() {
-	sf := shh.GetFilter(symFilterID)
-	if sf == nil {
-		utils.Fatalf("symmetric filter is not installed")
-	}
-
-	af := shh.GetFilter(asymFilterID)
-	if af == nil {
-		utils.Fatalf("asymmetric filter is not installed")
-	}
-
-	ticker := time.NewTicker(time.Millisecond * 50)
-
-	for {
-		select {
-		case <-ticker.C:
-			m1 := sf.Retrieve()
-			m2 := af.Retrieve()
-			messages := append(m1, m2...)
-			for _, msg := range messages {
-				reportedOnce := false
-				if !config.FileExMode && len(msg.Payload) <= 2048 {
-					printMessageInfo(msg)
-					reportedOnce = true
-				}
-
-				// All messages are saved upon specifying argSaveDir.
-				// fileExMode only specifies how messages are displayed on the console after they are saved.
-				// if fileExMode == true, only the hashes are displayed, since messages might be too big.
-				if len(config.ArgSaveDir) > 0 {
-					writeMessageToFile(config.ArgSaveDir, msg, !reportedOnce)
-				}
-			}
-		case <-done:
-			return
+func (n *Node) sendMsg(payload []byte) common.Hash {
+	h, err := n.Send(context.Background(), payload, nil)
+	if err != nil {
+		n.log.Error("failed to send message", "err", err)
+		if n.interactive {
+			fmt.Printf("failed to send message: %v \n", err)
 		}
+		return common.Hash{}
 	}
+	return h
 }
 
-func printMessageInfo(msg *whisper.ReceivedMessage) {
+func (n *Node) printMessageInfo(msg *whisper.ReceivedMessage) {
 	timestamp := fmt.Sprintf("%d", msg.Sent) // unix timestamp for diagnostics
 	text := string(msg.Payload)
 
@@ -638,14 +843,14 @@ func printMessageInfo(msg *whisper.ReceivedMessage) {
 		address = crypto.PubkeyToAddress(*msg.Src)
 	}
 
-	if whisper.IsPubKeyEqual(msg.Src, &asymKey.PublicKey) {
+	if whisper.IsPubKeyEqual(msg.Src, &n.asymKey.PublicKey) {
 		fmt.Printf("\nReal message %s <%x>: %s\n", timestamp, address, text) // message from myself
 	} else {
 		fmt.Printf("\nReal message %s [%x]: %s\n", timestamp, address, text) // message from a peer
 	}
 }
 
-func writeMessageToFile(dir string, msg *whisper.ReceivedMessage, show bool) {
+func (n *Node) writeMessageToFile(dir string, msg *whisper.ReceivedMessage, subscription string, show bool) {
 	if len(dir) == 0 {
 		return
 	}
@@ -658,9 +863,12 @@ func writeMessageToFile(dir string, msg *whisper.ReceivedMessage, show bool) {
 		address = crypto.PubkeyToAddress(*msg.Src)
 	}
 
-	env := shh.GetEnvelope(msg.EnvelopeHash)
+	env := n.shh.GetEnvelope(msg.EnvelopeHash)
 	if env == nil {
-		fmt.Printf("\nUnexpected error: envelope not found: %x\n", msg.EnvelopeHash)
+		n.log.Error("envelope of received message not found", "subscription", subscription, "hash", msg.EnvelopeHash.Hex())
+		if n.interactive {
+			fmt.Printf("\nUnexpected error: envelope not found: %x\n", msg.EnvelopeHash)
+		}
 		return
 	}
 
@@ -670,92 +878,107 @@ func writeMessageToFile(dir string, msg *whisper.ReceivedMessage, show bool) {
 	//	return
 	//}
 
-	fullpath := filepath.Join(dir, name)
-	err := ioutil.WriteFile(fullpath, env.Data, 0644)
+	// the whole envelope is saved, so that readers learn its topic and time
+	raw, err := rlp.EncodeToBytes(env)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, name), raw, 0644)
+	}
 	if err != nil {
-		fmt.Printf("\n%s {%x}: message received but not saved: %s\n", timestamp, address, err)
-	} else if show {
-		fmt.Printf("\n%s {%x}: message received and saved as '%s' (%d bytes)\n", timestamp, address, name, len(env.Data))
+		n.log.Warn("message not saved", "subscription", subscription, "hash", msg.EnvelopeHash.Hex(), "err", err)
+		if n.interactive {
+			fmt.Printf("\n%s {%x}: message received but not saved: %s\n", timestamp, address, err)
+		}
+		return
+	}
+	n.log.Info("message saved", "subscription", subscription, "hash", msg.EnvelopeHash.Hex(), "path", filepath.Join(dir, name), "size", len(raw))
+	if show {
+		fmt.Printf("\n%s {%x}: message received and saved as '%s' (%d bytes)\n", timestamp, address, name, len(raw))
 	}
 }
 
-func requestExpiredMessagesLoop() {
-	var key, peerID, bloom []byte
+func (n *Node) requestExpiredMessagesLoop() error {
 	var timeLow, timeUpp uint32
 	var t string
-	var xt whisper.TopicType
+	var err error
 
-	keyID, err := shh.AddSymKeyFromPassword(msPassword)
-	if err != nil {
-		utils.Fatalf("Failed to create symmetric key for mail request: %s", err)
-	}
-	key, err = shh.GetSymKey(keyID)
-	if err != nil {
-		utils.Fatalf("Failed to save symmetric key for mail request: %s", err)
+	if n.config.ArgMailFrom > 0 || n.config.ArgMailTo > 0 || len(n.config.ArgMailTopic) > 0 {
+		var topics []whisper.TopicType
+		if len(n.config.ArgMailTopic) > 0 {
+			if topics, err = parseTopics(n.config.ArgMailTopic); err != nil {
+				return &ConfigError{"ArgMailTopic", err}
+			}
+		}
+		return n.requestHistoryOnce(uint32(n.config.ArgMailFrom), uint32(n.config.ArgMailTo), topics)
 	}
-	peerID = extractIDFromEnode(config.ArgEnode)
-	shh.AllowP2PMessagesFromPeer(peerID)
 
 	for {
-		timeLow = scanUint("Please enter the lower limit of the time range (unix timestamp): ")
-		timeUpp = scanUint("Please enter the upper limit of the time range (unix timestamp): ")
-		t = scanLine("Enter the topic (hex). Press enter to request all messages, regardless of the topic: ")
+		if timeLow, err = scanUint("Please enter the lower limit of the time range (unix timestamp): "); err != nil {
+			return err
+		}
+		if timeUpp, err = scanUint("Please enter the upper limit of the time range (unix timestamp): "); err != nil {
+			return err
+		}
+		if t, err = scanLine("Enter the topic (hex). Press enter to request all messages, regardless of the topic: "); err != nil {
+			return err
+		}
+		var topics []whisper.TopicType
 		if len(t) == whisper.TopicLength*2 {
 			x, err := hex.DecodeString(t)
 			if err != nil {
 				fmt.Printf("Failed to parse the topic: %s \n", err)
 				continue
 			}
-			xt = whisper.BytesToTopic(x)
-			bloom = whisper.TopicToBloom(xt)
-			obfuscateBloom(bloom)
-		} else if len(t) == 0 {
-			bloom = whisper.MakeFullNodeBloom()
-		} else {
+			topics = append(topics, whisper.BytesToTopic(x))
+		} else if len(t) != 0 {
 			fmt.Println("Error: topic is invalid, request aborted")
 			continue
 		}
 
-		if timeUpp == 0 {
-			timeUpp = 0xFFFFFFFF
+		if err := n.requestHistoryOnce(timeLow, timeUpp, topics); err != nil {
+			return err
 		}
+	}
+}
 
-		data := make([]byte, 8, 8+whisper.BloomFilterSize)
-		binary.BigEndian.PutUint32(data, timeLow)
-		binary.BigEndian.PutUint32(data[4:], timeUpp)
-		data = append(data, bloom...)
-
-		var params whisper.MessageParams
-		params.PoW = config.ArgServerPoW
-		params.Payload = data
-		params.KeySym = key
-		params.Src = asymKey
-		params.WorkTime = 5
-
-		msg, err := whisper.NewSentMessage(&params)
-		if err != nil {
-			utils.Fatalf("failed to create new message: %s", err)
-		}
-		env, err := msg.Wrap(&params)
+// requestHistoryOnce requests the history from the node's mail server page
+// by page and reports the progress. The messages themselves are printed as
+// they arrive, by the node's own subscriptions.
+func (n *Node) requestHistoryOnce(from, to uint32, topics []whisper.TopicType) error {
+	q := HistoryQuery{From: from, To: to, Topics: topics, Limit: uint32(n.config.ArgMailLimit)}
+	total := 0
+	for pages := 1; ; pages++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.config.ArgMailTimeout)*time.Second)
+		page, err := n.RequestHistoryPage(ctx, n.config.mailServerEnode(), q)
+		cancel()
 		if err != nil {
-			utils.Fatalf("Wrap failed: %s", err)
+			if merr, ok := err.(*MailServerError); ok {
+				if merr.Err == context.DeadlineExceeded {
+					fmt.Printf("Mail server did not finish page %d in time, %d messages received \n", pages, total+len(page.Messages))
+					return nil
+				}
+				if refused, ok := merr.Err.(*RefusedError); ok {
+					fmt.Printf("Mail server refused page %d: %s \n", pages, refused.Reason)
+					return nil
+				}
+			}
+			return err
 		}
-
-		err = shh.RequestHistoricMessages(peerID, env)
-		if err != nil {
-			utils.Fatalf("Failed to send P2P message: %s", err)
+		total += len(page.Messages)
+		if page.Cursor == nil {
+			fmt.Printf("Mail server request complete, %d messages received in %d pages \n", total, pages)
+			return nil
 		}
-
-		time.Sleep(time.Second * 5)
+		fmt.Printf("Page %d received, %d messages so far \n", pages, total)
+		q.Cursor = page.Cursor
 	}
 }
 
-func extractIDFromEnode(s string) []byte {
+func extractIDFromEnode(s string) ([]byte, error) {
 	n, err := discover.ParseNode(s)
 	if err != nil {
-		utils.Fatalf("Failed to parse enode: %s", err)
+		return nil, fmt.Errorf("failed to parse enode: %s", err)
 	}
-	return n.ID[:]
+	return n.ID[:], nil
 }
 
 // obfuscateBloom adds 16 random bits to the the bloom
@@ -763,14 +986,14 @@ func extractIDFromEnode(s string) []byte {
 // it does so deterministically within every session.
 // despite additional bits, it will match on average
 // 32000 times less messages than full node's bloom filter.
-func obfuscateBloom(bloom []byte) {
+func (n *Node) obfuscateBloom(bloom []byte) {
 	const half = entropySize / 2
 	for i := 0; i < half; i++ {
-		x := int(entropy[i])
-		if entropy[half+i] < 128 {
+		x := int(n.entropy[i])
+		if n.entropy[half+i] < 128 {
 			x += 256
 		}
 
-		bloom[x/8] = 1 << uint(x%8) // set the bit number X
+		bloom[x/8] |= 1 << uint(x%8) // set the bit number X
 	}
 }
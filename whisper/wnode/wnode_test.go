@@ -0,0 +1,175 @@
+package wnode
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// testConfig returns the config of a node reachable on localhost only. The
+// nodes of a test find each other by their enodes, without discovery.
+func testConfig() *Config {
+	c := DefaultConfig
+	c.ArgSymPass = "test"
+	c.ArgTopic = "74657374"
+	c.NoDiscovery = true
+	c.ArgNAT = "none"
+	return &c
+}
+
+// startTestNode starts a bootstrap node without peers.
+func startTestNode(t *testing.T, c *Config) *Node {
+	c.BootstrapMode = true
+	c.ArgIP = "127.0.0.1:0"
+	n := NewNode(c)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start the node: %v", err)
+	}
+	return n
+}
+
+// startTestNodes starts a bootstrap node and a plain node connected to it.
+func startTestNodes(t *testing.T, boot, plain *Config) (*Node, *Node) {
+	boot.BootstrapMode = true
+	boot.ArgIP = "127.0.0.1:0"
+	b := NewNode(boot)
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start the bootstrap node: %v", err)
+	}
+
+	plain.ArgEnode = b.Enode()
+	p := NewNode(plain)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := p.Start(ctx); err != nil {
+		b.Stop()
+		t.Fatalf("failed to start the plain node: %v", err)
+	}
+	return b, p
+}
+
+func TestTwoNodes(t *testing.T) {
+	b, p := startTestNodes(t, testConfig(), testConfig())
+	defer b.Stop()
+	defer p.Stop()
+
+	if b.Enode() == p.Enode() {
+		t.Fatalf("nodes share the enode %s", b.Enode())
+	}
+	payload := []byte("hello boot node")
+	if _, err := p.Send(context.Background(), payload, nil); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-b.Messages():
+			if bytes.Equal(msg.Payload, payload) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("message did not reach the bootstrap node")
+		}
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	n := startTestNode(t, testConfig())
+	defer n.Stop()
+
+	// a symmetric key of the wrong length fails when the message is sealed
+	_, err := n.Send(context.Background(), []byte("hello"), &SendOptions{SymKey: []byte("short")})
+	var netErr *NetworkError
+	if !errors.As(err, &netErr) || netErr.Op != "send" {
+		t.Errorf("send with a short key: got %v, want a NetworkError", err)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	b, p := startTestNodes(t, testConfig(), testConfig())
+	p.Stop()
+	p.Stop()
+	b.Stop()
+	b.Stop()
+}
+
+func TestNotStarted(t *testing.T) {
+	n := NewNode(testConfig())
+	n.Stop()
+	if n.PublicKey() != nil {
+		t.Error("public key before Start")
+	}
+	if n.Enode() != "" {
+		t.Error("enode before Start")
+	}
+	if n.Messages() == nil {
+		t.Error("no message channel before Start")
+	}
+	if peers := n.StaticPeers(); peers != nil {
+		t.Errorf("static peers before Start: %v", peers)
+	}
+	if err := n.AddPeer("enode://00@127.0.0.1:30303"); err != ErrNotStarted {
+		t.Errorf("AddPeer before Start: got %v, want ErrNotStarted", err)
+	}
+	if err := n.RemovePeer("enode://00@127.0.0.1:30303"); err != ErrNotStarted {
+		t.Errorf("RemovePeer before Start: got %v, want ErrNotStarted", err)
+	}
+	if _, err := n.Send(context.Background(), []byte("hello"), nil); err != ErrNotStarted {
+		t.Errorf("Send before Start: got %v, want ErrNotStarted", err)
+	}
+	if _, err := n.SendFile(context.Background(), "wnode_test.go", nil); err != ErrNotStarted {
+		t.Errorf("SendFile before Start: got %v, want ErrNotStarted", err)
+	}
+	if _, err := n.RequestHistory(context.Background(), "enode://00@127.0.0.1:30303", 0, 0, nil); err != ErrNotStarted {
+		t.Errorf("RequestHistory before Start: got %v, want ErrNotStarted", err)
+	}
+	if _, err := n.RequestHistoryPage(context.Background(), "enode://00@127.0.0.1:30303", HistoryQuery{}); err != ErrNotStarted {
+		t.Errorf("RequestHistoryPage before Start: got %v, want ErrNotStarted", err)
+	}
+	if err := n.Subscribe("extra", SubscriptionConfig{Topics: n.Topics(), SymPass: "extra"}); err != ErrNotStarted {
+		t.Errorf("Subscribe before Start: got %v, want ErrNotStarted", err)
+	}
+	if err := n.Unsubscribe(DefaultSymSubscription); err != ErrNotStarted {
+		t.Errorf("Unsubscribe before Start: got %v, want ErrNotStarted", err)
+	}
+	if _, err := n.SyncArchive(context.Background(), "http://127.0.0.1:8547", 0, 0); err != ErrNotStarted {
+		t.Errorf("SyncArchive before Start: got %v, want ErrNotStarted", err)
+	}
+}
+
+func TestStartFailureReleasesStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wnode-start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := testConfig()
+	c.BootstrapMode = true
+	c.MailServerMode = true
+	c.ArgDBPath = dir
+	c.ArgIP = l.Addr().String() // taken, the p2p server fails to start
+	n := NewNode(c)
+	if err := n.Start(context.Background()); err == nil {
+		n.Stop()
+		t.Fatal("node started on a port in use")
+	}
+	l.Close()
+
+	// the store was closed, so a retry can open it
+	c.ArgIP = "127.0.0.1:0"
+	n = NewNode(c)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	n.Stop()
+}